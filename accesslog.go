@@ -0,0 +1,203 @@
+package metaimport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestIDHeader is the header carrying the ID of a request.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen is the maximum length of the request IDs accepted
+// from the clients.
+const maxRequestIDLen = 128
+
+// requestInfo holds the information about a request gathered while it's
+// served, for the logs, the metrics and the traces.
+type requestInfo struct {
+	id     string
+	mu     sync.Mutex
+	pkg    string
+	prefix string
+	vcs    string
+}
+
+type requestInfoKey struct{}
+
+// requestInfoFrom returns the information about the request whose
+// context is ctx, nil if it's not gathered.
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// RequestID returns the ID of the request whose context is ctx, an
+// empty string if it's not a request served by a handler. It can be
+// used to add the ID to the log records of the request.
+func RequestID(ctx context.Context) string {
+	if info := requestInfoFrom(ctx); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+// requestID returns the ID of the request r: the one sent by the client,
+// a proxy in front of the server for example, if it's valid, a random
+// one otherwise.
+func requestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" || len(id) > maxRequestIDLen {
+		return randomID(16)
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return randomID(16)
+		}
+	}
+	return id
+}
+
+// setPackage records that the package pkgName has been requested.
+func (info *requestInfo) setPackage(pkgName string) {
+	if info == nil {
+		return
+	}
+	info.mu.Lock()
+	info.pkg = pkgName
+	info.mu.Unlock()
+}
+
+// setMatch records that the requested package has been resolved to mi.
+func (info *requestInfo) setMatch(mi *MetaImport) {
+	if info == nil {
+		return
+	}
+	info.mu.Lock()
+	info.prefix = mi.Prefix
+	info.vcs = mi.VCS
+	info.mu.Unlock()
+}
+
+// accessRecord is an access log record.
+type accessRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	ClientIP  string    `json:"client_ip"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Package   string    `json:"package,omitempty"`
+	Prefix    string    `json:"prefix,omitempty"`
+	Status    int       `json:"status"`
+	Duration  float64   `json:"duration"`
+	UserAgent string    `json:"user_agent"`
+}
+
+// instrument returns a handler identifying the requests served by next,
+// the ID being echoed in the response, and gathering information about
+// them to write the access logs, record the metrics and the traces.
+func (h *Handler) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{id: requestID(r)}
+		w.Header().Set(requestIDHeader, info.id)
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		var s *span
+		if h.Tracer != nil {
+			s = h.Tracer.start(r)
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		d := time.Since(start)
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if h.Metrics != nil {
+			h.Metrics.observe(status, d)
+		}
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		if s != nil {
+			h.Tracer.end(s, info, status)
+		}
+		if h.AccessLog == nil {
+			return
+		}
+		if h.conf.AccessLog == "combined" {
+			h.AccessLog.Write(combinedRecord(r, h.conf.clientIP(r), start, status, rec.size))
+			return
+		}
+		rc := accessRecord{
+			Time:      start.UTC(),
+			RequestID: info.id,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Package:   info.pkg,
+			Prefix:    info.prefix,
+			Status:    status,
+			Duration:  d.Seconds(),
+			UserAgent: r.UserAgent(),
+		}
+		if ip := h.conf.clientIP(r); ip != nil {
+			rc.ClientIP = ip.String()
+		}
+		data, err := json.Marshal(rc)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to encode the access log record", "err", err)
+			return
+		}
+		h.AccessLog.Write(append(data, '\n'))
+	})
+}
+
+// combinedRecord returns the access log record of the request r, sent
+// by the client whose address is ip, received at t and answered with
+// the status code status and a body of size bytes, in the Apache
+// combined log format.
+func combinedRecord(r *http.Request, ip net.IP, t time.Time, status int, size int64) []byte {
+	host := "-"
+	if ip != nil {
+		host = ip.String()
+	}
+	user := "-"
+	if u, _, ok := r.BasicAuth(); ok && u != "" {
+		user = escapeLogField(u)
+	}
+	bytes := "-"
+	if size > 0 {
+		bytes = strconv.FormatInt(size, 10)
+	}
+	referer := "-"
+	if v := r.Referer(); v != "" {
+		referer = escapeLogField(v)
+	}
+	request := escapeLogField(r.Method + " " + r.RequestURI + " " + r.Proto)
+	return []byte(fmt.Sprintf("%s - %s [%s] \"%s\" %d %s \"%s\" \"%s\"\n",
+		host, user, t.Format("02/Jan/2006:15:04:05 -0700"), request, status, bytes, referer, escapeLogField(r.UserAgent())))
+}
+
+// escapeLogField escapes the quotes, the backslashes and the non
+// printable characters of s, as Apache does.
+func escapeLogField(s string) string {
+	b := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
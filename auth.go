@@ -0,0 +1,163 @@
+package metaimport
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const defaultRealm = "metaimport"
+
+// Auth holds the credentials required to resolve the packages of an
+// import path, sent with the Basic authentication or as bearer tokens,
+// and whether a client certificate is required.
+type Auth struct {
+	Realm      string            `doc:"Realm of the authentication" default:"metaimport"`
+	Users      map[string]string `doc:"Passwords of the users allowed by name, hashed with bcrypt or SHA-1 ({SHA}) or in plain text"`
+	UsersFile  string            `json:"users_file" doc:"htpasswd file holding more users, read when the configuration is loaded, whose passwords are hashed with bcrypt or SHA-1 ({SHA}) or in plain text"`
+	Tokens     []string          `doc:"Bearer tokens allowed"`
+	TokensFile string            `json:"tokens_file" doc:"File holding more bearer tokens, one per line, read when the configuration is loaded"`
+	ClientCert bool              `json:"client_cert" doc:"Require a client certificate verified against the client_ca of the TLS settings, in addition to the credentials if there are any"`
+	users      map[string]string
+	tokens     []string
+}
+
+// load loads the users and the tokens of a, the ones of the
+// configuration being used as written. The empty passwords and tokens
+// are rejected as they would match the credentials left empty.
+func (a *Auth) load() error {
+	a.users = map[string]string{}
+	for name, password := range a.Users {
+		if password == "" {
+			return fmt.Errorf("empty password for user %s", name)
+		}
+		a.users[name] = password
+	}
+	for i, token := range a.Tokens {
+		if token == "" {
+			return fmt.Errorf("empty token %d", i)
+		}
+	}
+	a.tokens = append([]string(nil), a.Tokens...)
+	if a.UsersFile != "" {
+		err := readLines(a.UsersFile, func(line string) error {
+			name, password, ok := strings.Cut(line, ":")
+			if !ok || password == "" {
+				return errors.New("missing password")
+			}
+			a.users[name] = password
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if a.TokensFile != "" {
+		return readLines(a.TokensFile, func(line string) error {
+			a.tokens = append(a.tokens, line)
+			return nil
+		})
+	}
+	return nil
+}
+
+// readLines calls fn with each line of the file name, except the empty
+// ones and the comments, starting with #.
+func readLines(name string, fn func(line string) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("%s:%d: %s", name, n, err)
+		}
+	}
+	return s.Err()
+}
+
+// checkPassword reports whether password matches the one stored for a
+// user, hashed or in plain text.
+func checkPassword(stored, password string) bool {
+	switch {
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	case strings.HasPrefix(stored, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		stored = strings.TrimPrefix(stored, "{SHA}")
+		password = base64.StdEncoding.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+// verifiedCert reports whether r has been sent with a verified client
+// certificate.
+func verifiedCert(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// authorized reports whether r carries the credentials of one of the
+// users of a or one of its tokens, any request being authorized if a is
+// nil. If a requires a client certificate, it must have been sent with
+// a verified one.
+func (a *Auth) authorized(r *http.Request) bool {
+	if a == nil {
+		return true
+	}
+	if a.ClientCert && !verifiedCert(r) {
+		return false
+	}
+	if len(a.users) == 0 && len(a.tokens) == 0 && a.ClientCert {
+		return true
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		valid := false
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				valid = true
+			}
+		}
+		return valid
+	}
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	stored, ok := a.users[name]
+	return ok && checkPassword(stored, password)
+}
+
+// challenge answers the request r which is not authorized by a with a
+// 401 error asking for the credentials it accepts, or a 403 error if it
+// has been sent without the required client certificate.
+func (a *Auth) challenge(w http.ResponseWriter, r *http.Request) {
+	if a.ClientCert && !verifiedCert(r) {
+		http.Error(w, "client certificate required", http.StatusForbidden)
+		return
+	}
+	realm := a.Realm
+	if realm == "" {
+		realm = defaultRealm
+	}
+	if len(a.users) > 0 || len(a.tokens) == 0 {
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm))
+	}
+	if len(a.tokens) > 0 {
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", realm))
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
@@ -0,0 +1,147 @@
+package metaimport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testAuthConfig = `{
+  "paths": [
+    {
+      "prefix": "example.com/private",
+      "vcs": "git",
+      "repo_template": "https://git.example.com/private.git",
+      "auth": {
+        "users": {
+          "alice": "$2a$04$R.i1ojUBlQO3URWZxz87Gu2Q6OGKBEw.BUQl9tnoxuoNLxoZL5ZQ6",
+          "bob": "pa$$word",
+          "carol": "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="
+        },
+        "tokens": ["t0k$en"]
+      }
+    }
+  ]
+}`
+
+func TestAuthUsers(t *testing.T) {
+	conf, err := ParseConfig(strings.NewReader(testAuthConfig), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+	a := conf.Paths[0].Auth
+	tests := []struct {
+		user     string
+		password string
+		want     bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "pa$$word", true},
+		{"bob", "paword", false},
+		{"carol", "secret", true},
+		{"carol", "", false},
+		{"dave", "secret", false},
+	}
+	for _, test := range tests {
+		r := &http.Request{Header: http.Header{}}
+		r.SetBasicAuth(test.user, test.password)
+		if got := a.authorized(r); got != test.want {
+			t.Errorf("authorized(%s:%s) = %v, want %v", test.user, test.password, got, test.want)
+		}
+	}
+	if a.authorized(&http.Request{Header: http.Header{}}) {
+		t.Error("authorized without credentials")
+	}
+}
+
+func TestAuthTokens(t *testing.T) {
+	conf, err := ParseConfig(strings.NewReader(testAuthConfig), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+	a := conf.Paths[0].Auth
+	for _, test := range []struct {
+		token string
+		want  bool
+	}{
+		{"t0k$en", true},
+		{"t0k", false},
+		{"", false},
+	} {
+		r := &http.Request{Header: http.Header{"Authorization": {"Bearer " + test.token}}}
+		if got := a.authorized(r); got != test.want {
+			t.Errorf("authorized(Bearer %s) = %v, want %v", test.token, got, test.want)
+		}
+	}
+	conf.Paths[0].Auth.Tokens = append(conf.Paths[0].Auth.Tokens, "")
+	if errs := conf.Check(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "empty token") {
+		t.Errorf("Check() = %v, want an empty token error", errs)
+	}
+}
+
+func TestAuthEmpty(t *testing.T) {
+	for _, auth := range []string{
+		`{"tokens": ["t0k3n", ""]}`,
+		`{"users": {"alice": ""}}`,
+	} {
+		conf, err := ParseConfig(strings.NewReader(`{"paths": [{"prefix": "example.com/private", "vcs": "git", "repo_template": "https://git.example.com/private.git", "auth": `+auth+`}]}`), "json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := New(conf); err == nil {
+			t.Errorf("New with auth %s succeeded, want an error", auth)
+		}
+	}
+}
+
+func TestCacheControlProtected(t *testing.T) {
+	conf, err := ParseConfig(strings.NewReader(`{
+  "cache_control": "public, max-age=3600",
+  "paths": [
+    {"prefix": "example.com/public", "vcs": "git", "repo_template": "https://git.example.com/public.git"},
+    {"prefix": "example.com/private", "vcs": "git", "repo_template": "https://git.example.com/private.git", "auth": {"users": {"alice": "secret"}}}
+  ]
+}`), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path  string
+		cache string
+		vary  string
+	}{
+		{"/public/pkg?go-get=1", "public, max-age=3600", ""},
+		{"/private/pkg?go-get=1", "private", "Authorization"},
+		// The index lists the protected import paths to some clients
+		{"/", "private", "Authorization"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com"+test.path, nil)
+		r.Header.Set("Accept", "text/html")
+		r.SetBasicAuth("alice", "secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s: got status %d, want 200", test.path, w.Code)
+			continue
+		}
+		if got := w.Header().Get("Cache-Control"); got != test.cache {
+			t.Errorf("GET %s: Cache-Control = %q, want %q", test.path, got, test.cache)
+		}
+		if got := w.Header().Get("Vary"); got != test.vary {
+			t.Errorf("GET %s: Vary = %q, want %q", test.path, got, test.vary)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package metaimport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// knownVCS holds the version control systems supported by the go
+// command.
+var knownVCS = map[string]bool{
+	"bzr":    true,
+	"fossil": true,
+	"git":    true,
+	"hg":     true,
+	"mod":    true,
+	"svn":    true,
+}
+
+// Check returns the problems found in the configuration.
+func (conf *Config) Check() []error {
+	if conf.tmpl == nil {
+		if err := conf.compile(); err != nil {
+			return []error{err}
+		}
+	}
+	var errs []error
+	if conf.Redirect != "" && !redirectTargets[conf.Redirect] {
+		errs = append(errs, fmt.Errorf("conf: unknown redirect %q", conf.Redirect))
+	}
+	unixSocket := false
+	for _, addr := range conf.Listen {
+		if strings.HasPrefix(addr, "unix:") {
+			unixSocket = true
+		} else if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("conf: bad listen address %q, expected host:port or unix:path", addr))
+		}
+	}
+	if conf.Group != "" && conf.User == "" {
+		errs = append(errs, fmt.Errorf("conf: group can't be set without user"))
+	}
+	if conf.SocketMode != "" {
+		if _, err := strconv.ParseUint(conf.SocketMode, 8, 32); err != nil {
+			errs = append(errs, fmt.Errorf("conf: bad socket_mode %q, expected octal permissions such as 0660", conf.SocketMode))
+		}
+	}
+	if t := conf.Tls; t != nil {
+		switch {
+		case t.ACME != nil && (t.Cert != "" || t.PrivKey != "" || len(t.Certs) > 0):
+			errs = append(errs, fmt.Errorf("conf: cert, priv_key and certs can't be set with acme"))
+		case (t.Cert == "") != (t.PrivKey == ""):
+			errs = append(errs, fmt.Errorf("conf: cert and priv_key must be set together"))
+		case t.ACME == nil && t.Cert == "" && len(t.Certs) == 0:
+			errs = append(errs, fmt.Errorf("conf: TLS requires cert and priv_key or certs unless acme is set"))
+		case t.ACME != nil && t.ACME.Cache == "":
+			errs = append(errs, fmt.Errorf("conf: acme requires cache"))
+		}
+		if t.ACME != nil && t.ACME.DNS != nil {
+			d := t.ACME.DNS
+			if len(t.ACME.Hosts) == 0 {
+				errs = append(errs, fmt.Errorf("conf: acme dns requires hosts"))
+			}
+			switch d.Provider {
+			case "rfc2136":
+				if d.Nameserver == "" || d.Zone == "" {
+					errs = append(errs, fmt.Errorf("conf: dns provider rfc2136 requires nameserver and zone"))
+				}
+				switch d.TSIGAlgorithm {
+				case "", "hmac-sha1", "hmac-sha256", "hmac-sha512":
+				default:
+					errs = append(errs, fmt.Errorf("conf: unknown tsig algorithm %q", d.TSIGAlgorithm))
+				}
+			case "exec":
+				if len(d.Command) == 0 {
+					errs = append(errs, fmt.Errorf("conf: dns provider exec requires command"))
+				}
+			default:
+				errs = append(errs, fmt.Errorf("conf: unknown dns provider %q, expected rfc2136 or exec", d.Provider))
+			}
+		}
+		if t.HTTP3 && unixSocket {
+			errs = append(errs, fmt.Errorf("conf: http3 can't be used when listening on a Unix domain socket"))
+		}
+		if t.RedirectAddr != "" && t.ACME != nil && t.ACME.HTTPAddr != "" {
+			errs = append(errs, fmt.Errorf("conf: redirect_addr can't be set with acme http_addr"))
+		}
+		if err := t.Apply(&tls.Config{}); err != nil {
+			errs = append(errs, err)
+		}
+		switch t.ClientAuth {
+		case "", "request":
+		case "require":
+			if t.ClientCA == "" {
+				errs = append(errs, fmt.Errorf("conf: client_auth require requires client_ca"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("conf: unknown client_auth %q, expected request or require", t.ClientAuth))
+		}
+	}
+	if p := conf.Proxy; p != nil {
+		if p.Path != "" && !strings.HasPrefix(p.Path, "/") {
+			errs = append(errs, fmt.Errorf("conf: proxy path %q must start with /", p.Path))
+		}
+		if p.Upstream == "" && p.Cache == "" {
+			errs = append(errs, fmt.Errorf("conf: proxy requires cache unless upstream is set"))
+		}
+		if u, err := url.Parse(p.Upstream); p.Upstream != "" && (err != nil || u.Scheme == "" || u.Host == "") {
+			errs = append(errs, fmt.Errorf("conf: bad upstream proxy %q", p.Upstream))
+		}
+	}
+	switch conf.AccessLog {
+	case "", "json", "combined", "none":
+	default:
+		errs = append(errs, fmt.Errorf("conf: unknown access log format %q, expected json, combined or none", conf.AccessLog))
+	}
+	if l := conf.Log; l != nil {
+		var level slog.Level
+		if l.Level != "" {
+			if err := level.UnmarshalText([]byte(l.Level)); err != nil {
+				errs = append(errs, fmt.Errorf("conf: unknown log level %q, expected debug, info, warn or error", l.Level))
+			}
+		}
+		switch l.Format {
+		case "", "text", "json":
+		default:
+			errs = append(errs, fmt.Errorf("conf: unknown log format %q, expected text or json", l.Format))
+		}
+		if sl := l.Syslog; sl != nil {
+			switch sl.Network {
+			case "", "udp", "tcp", "unix":
+			default:
+				errs = append(errs, fmt.Errorf("conf: unknown syslog network %q, expected udp, tcp or unix", sl.Network))
+			}
+			if sl.FacilityCode() < 0 {
+				errs = append(errs, fmt.Errorf("conf: unknown syslog facility %q", sl.Facility))
+			}
+		}
+	}
+	if t := conf.Tracing; t != nil {
+		if u, err := url.Parse(t.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("conf: bad tracing endpoint %q", t.Endpoint))
+		}
+	}
+	seen := map[string]int{}
+	for i := range conf.Paths {
+		p := &conf.Paths[i]
+		if p.Prefix == "" && p.re == nil {
+			errs = append(errs, fmt.Errorf("conf: path %d: empty prefix", i))
+			continue
+		}
+		// The import paths matched by a regexp can share their prefix
+		if j, ok := seen[p.Prefix]; ok && p.re == nil {
+			errs = append(errs, fmt.Errorf("conf: path %d (%s): prefix already used by path %d, which is never matched", i, p.Prefix, j))
+		}
+		if p.re == nil {
+			seen[p.Prefix] = i
+		}
+		if !knownVCS[p.VCS] {
+			errs = append(errs, fmt.Errorf("conf: path %d (%s): unknown vcs %q", i, p.Prefix, p.VCS))
+		}
+		switch p.Mode {
+		case "", "vcs":
+		case "mod":
+			if p.ProxyTemplate == "" {
+				errs = append(errs, fmt.Errorf("conf: path %d (%s): mode mod requires proxy_template", i, p.Prefix))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("conf: path %d (%s): unknown mode %q, expected vcs or mod", i, p.Prefix, p.Mode))
+		}
+		if p.Redirect != "" && !redirectTargets[p.Redirect] {
+			errs = append(errs, fmt.Errorf("conf: path %d (%s): unknown redirect %q", i, p.Prefix, p.Redirect))
+		}
+		if p.Auth != nil {
+			for name, password := range p.Auth.Users {
+				if password == "" {
+					errs = append(errs, fmt.Errorf("conf: path %d (%s): empty password for user %s", i, p.Prefix, name))
+				}
+			}
+			for j, token := range p.Auth.Tokens {
+				if token == "" {
+					errs = append(errs, fmt.Errorf("conf: path %d (%s): empty token %d", i, p.Prefix, j))
+				}
+			}
+		}
+		if p.Auth != nil && p.Auth.ClientCert && (conf.Tls == nil || conf.Tls.ClientCA == "") {
+			errs = append(errs, fmt.Errorf("conf: path %d (%s): client_cert requires the client_ca of the TLS settings", i, p.Prefix))
+		}
+		if _, ok := forgeAPIs[p.Forge]; p.Readme && !ok {
+			errs = append(errs, fmt.Errorf("conf: path %d (%s): readme requires forge to be github, gitlab or gitea", i, p.Prefix))
+		}
+		if _, ok := forges[p.Forge]; p.Forge != "" && !ok {
+			errs = append(errs, fmt.Errorf("conf: path %d (%s): unknown forge %q, expected one of %s", i, p.Prefix, p.Forge, strings.Join(forgeNames(), ", ")))
+		}
+		if n := len(strings.Split(p.Prefix, "/")); p.NbComponents < n {
+			errs = append(errs, fmt.Errorf("conf: path %d (%s): nb_components (%d) is lower than the number of components of the prefix (%d)", i, p.Prefix, p.NbComponents, n))
+			continue
+		}
+		// Render the templates for the shortest package name
+		// matched to catch errors such as out of range indexes
+		components := strings.Split(p.Prefix, "/")
+		for len(components) < p.NbComponents {
+			components = append(components, "x")
+		}
+		if p.re != nil {
+			components = make([]string, p.re.NumSubexp()+1)
+			for j := range components {
+				components[j] = "x"
+			}
+		}
+		for _, name := range conf.templateNames(i) {
+			if err := conf.tmpl.ExecuteTemplate(ioutil.Discard, name, components); err != nil {
+				errs = append(errs, fmt.Errorf("conf: path %d (%s): %s", i, p.Prefix, err))
+			}
+		}
+	}
+	return errs
+}
+
+// Lint returns warnings about import paths which are valid but most
+// likely don't behave as intended.
+func (conf *Config) Lint() []string {
+	var warnings []string
+	for i := range conf.Paths {
+		p := &conf.Paths[i]
+		if p.Prefix == "" {
+			continue
+		}
+		n := len(strings.Split(p.Prefix, "/"))
+		if p.NbComponents > n {
+			warnings = append(warnings, fmt.Sprintf("path %d (%s): nb_components (%d) exceeds the number of components of the prefix (%d), packages with less than %d components won't match", i, p.Prefix, p.NbComponents, n, p.NbComponents))
+		}
+		if p.Readme && p.Regexp != "" {
+			warnings = append(warnings, fmt.Sprintf("path %d (%s): readme is ignored as the path is matched by a regexp", i, p.Prefix))
+		}
+		if len(p.VCSNetworks) > 0 && p.Mode != "mod" {
+			warnings = append(warnings, fmt.Sprintf("path %d (%s): vcs_networks is ignored as mode is not mod", i, p.Prefix))
+		}
+		for j := range conf.Paths {
+			q := &conf.Paths[j]
+			if i == j || p.re != nil || len(q.Prefix) <= len(p.Prefix) || !strings.HasPrefix(q.Prefix, p.Prefix) {
+				continue
+			}
+			if !strings.HasSuffix(p.Prefix, "/") && q.Prefix[len(p.Prefix)] != '/' {
+				warnings = append(warnings, fmt.Sprintf("path %d (%s): prefix also matches the packages of path %d (%s), which is not below it", i, p.Prefix, j, q.Prefix))
+			}
+		}
+	}
+	return warnings
+}
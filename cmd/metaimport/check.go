@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/montag451/metaimport"
+)
+
+// report logs the problems found in the configuration and returns an
+// error if some of them are errors rather than warnings.
+func report(conf *metaimport.Config) error {
+	errs := conf.Check()
+	for _, err := range errs {
+		log.Print(err)
+	}
+	for _, w := range conf.Lint() {
+		log.Printf("conf: warning: %s", w)
+	}
+	if len(errs) > 0 {
+		return errors.New("conf: invalid configuration")
+	}
+	return nil
+}
+
+func checkCommand(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	name := fs.Arg(0)
+	conf, err := metaimport.LoadConfig(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	errs := conf.Check()
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("%s: OK\n", name)
+}
+
+func lintCommand(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	name := fs.Arg(0)
+	conf, err := metaimport.LoadConfig(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	errs := conf.Check()
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	warnings := conf.Lint()
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "conf: warning: %s\n", w)
+	}
+	if len(errs) > 0 || len(warnings) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("%s: OK\n", name)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/montag451/metaimport"
+	"gopkg.in/yaml.v3"
+)
+
+// configValue returns v as a value made of maps, slices and scalars,
+// using the names of the settings as keys. Settings with a zero value
+// are omitted.
+func configValue(v reflect.Value) interface{} {
+	if v.Type() == durationType {
+		return v.Interface().(metaimport.Duration).String()
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return configValue(v.Elem())
+	case reflect.Struct:
+		m := map[string]interface{}{}
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath != "" || v.Field(i).IsZero() {
+				continue
+			}
+			m[jsonName(f)] = configValue(v.Field(i))
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		l := make([]interface{}, v.Len())
+		for i := range l {
+			l[i] = configValue(v.Index(i))
+		}
+		return l
+	case reflect.Map:
+		m := map[string]interface{}{}
+		for _, k := range v.MapKeys() {
+			m[fmt.Sprint(k.Interface())] = configValue(v.MapIndex(k))
+		}
+		return m
+	}
+	return v.Interface()
+}
+
+// encodeConfig writes conf to w in the given format.
+func encodeConfig(w io.Writer, conf *metaimport.Config, format string) error {
+	v := configValue(reflect.ValueOf(conf))
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	case "yaml":
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		return encoder.Encode(v)
+	case "toml":
+		return toml.NewEncoder(w).Encode(v)
+	default:
+		return fmt.Errorf("unsupported output format %q", format)
+	}
+}
+
+type govanityurlsConfig struct {
+	Host  string
+	Paths map[string]struct {
+		Repo    string
+		VCS     string
+		Display string
+	}
+}
+
+// fromGovanityurls returns the configuration equivalent to the
+// govanityurls configuration read from r. The host is used when the
+// configuration doesn't hold one.
+func fromGovanityurls(r io.Reader, host string) (*metaimport.Config, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var vc govanityurlsConfig
+	if err := yaml.Unmarshal(data, &vc); err != nil {
+		return nil, err
+	}
+	if vc.Host != "" {
+		host = vc.Host
+	}
+	if host == "" {
+		return nil, fmt.Errorf("no host in the configuration, use -host")
+	}
+	paths := make([]string, 0, len(vc.Paths))
+	for p := range vc.Paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	conf := &metaimport.Config{}
+	for _, p := range paths {
+		e := vc.Paths[p]
+		vcs := e.VCS
+		if vcs == "" {
+			// govanityurls guesses the VCS for well known hosts
+			switch {
+			case strings.HasPrefix(e.Repo, "https://github.com/"),
+				strings.HasPrefix(e.Repo, "https://bitbucket.org/"):
+				vcs = "git"
+			default:
+				return nil, fmt.Errorf("%s: vcs is required for %q", p, e.Repo)
+			}
+		}
+		ip := metaimport.ImportPath{
+			Prefix:       host + "/" + strings.Trim(p, "/"),
+			VCS:          vcs,
+			RepoTemplate: escapeTemplate(e.Repo),
+		}
+		if e.Display != "" {
+			// display holds the URLs of the go-source meta tag
+			urls := strings.Fields(e.Display)
+			if len(urls) != 3 {
+				return nil, fmt.Errorf("%s: bad display %q", p, e.Display)
+			}
+			ip.Source = &metaimport.SourceTemplates{
+				HomeTemplate:      escapeTemplate(urls[0]),
+				DirectoryTemplate: escapeTemplate(urls[1]),
+				FileTemplate:      escapeTemplate(urls[2]),
+			}
+		}
+		conf.Paths = append(conf.Paths, ip)
+	}
+	return conf, nil
+}
+
+// escapeTemplate returns a template rendering s as is.
+func escapeTemplate(s string) string {
+	if !strings.Contains(s, "{{") {
+		return s
+	}
+	return "{{ " + strconv.Quote(s) + " }}"
+}
+
+func convertCommand(fs *flag.FlagSet, args []string) {
+	host := fs.String("host", "", "host of the import paths, when not given by the configuration")
+	format := fs.String("format", "json", "output format: json, yaml or toml")
+	fs.Parse(args)
+	if fs.NArg() != 2 || fs.Arg(0) != "govanityurls" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	f, err := os.Open(fs.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	conf, err := fromGovanityurls(f, *host)
+	if err != nil {
+		log.Fatalf("%s: %s", fs.Arg(1), err)
+	}
+	if err := encodeConfig(os.Stdout, conf, *format); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// configDomain returns domain if it's not empty or the domain of the
+// import paths of conf otherwise, provided they all share the same.
+func configDomain(conf *metaimport.Config, domain string) (string, error) {
+	if domain != "" {
+		return domain, nil
+	}
+	for _, p := range conf.Paths {
+		d := strings.Split(p.Prefix, "/")[0]
+		if domain != "" && d != domain {
+			return "", fmt.Errorf("import paths with several domains, use -domain")
+		}
+		domain = d
+	}
+	return domain, nil
+}
+
+type vangenConfig struct {
+	Domain       string             `json:"domain"`
+	Repositories []vangenRepository `json:"repositories"`
+}
+
+type vangenRepository struct {
+	Prefix string        `json:"prefix"`
+	Type   string        `json:"type"`
+	URL    string        `json:"url"`
+	Source *vangenSource `json:"source,omitempty"`
+}
+
+type vangenSource struct {
+	Home string `json:"home"`
+	Dir  string `json:"dir"`
+	File string `json:"file"`
+}
+
+// toVangen returns the vangen configuration equivalent to the
+// import paths of conf under domain. Import paths whose repository
+// depends on the package name can't be exported and are skipped.
+func toVangen(conf *metaimport.Config, domain string) (*vangenConfig, error) {
+	domain, err := configDomain(conf, domain)
+	if err != nil {
+		return nil, err
+	}
+	resolver, err := metaimport.NewResolver(conf)
+	if err != nil {
+		return nil, err
+	}
+	vc := &vangenConfig{Domain: domain}
+	for i, p := range conf.Paths {
+		if p.Regexp != "" {
+			log.Printf("path %d (%s): matched by a regexp, skipping it", i, p.Regexp)
+			continue
+		}
+		components := strings.Split(p.Prefix, "/")
+		if components[0] != domain {
+			continue
+		}
+		if p.NbComponents != len(components) {
+			log.Printf("path %d (%s): repository depends on the package name, skipping it", i, p.Prefix)
+			continue
+		}
+		if len(components) < 2 {
+			continue
+		}
+		mi, err := resolver.Resolve(p.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("path %d (%s): %s", i, p.Prefix, err)
+		}
+		if mi.Index != i {
+			// Shadowed by another import path
+			continue
+		}
+		r := vangenRepository{
+			Prefix: strings.Join(components[1:], "/"),
+			Type:   mi.VCS,
+			URL:    mi.Repo,
+		}
+		if mi.Source != nil {
+			r.Source = &vangenSource{mi.Source.Home, mi.Source.Directory, mi.Source.File}
+		}
+		vc.Repositories = append(vc.Repositories, r)
+	}
+	return vc, nil
+}
+
+func exportCommand(fs *flag.FlagSet, args []string) {
+	domain := fs.String("domain", "", "domain of the exported import paths, required when there are several")
+	fs.Parse(args)
+	if fs.NArg() != 2 || fs.Arg(0) != "vangen" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	conf, err := metaimport.LoadConfig(fs.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	vc, err := toVangen(conf, *domain)
+	if err != nil {
+		log.Fatal(err)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(vc); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/montag451/metaimport"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// accountKey is the name of the account key in the cache
+	accountKey = "acme_account+key"
+	// dnsCertKey is the name of the certificate in the cache
+	dnsCertKey = "dns01+cert"
+	// renewCheckInterval is the interval between two checks of the
+	// expiry of the certificate
+	renewCheckInterval = 12 * time.Hour
+	// renewBefore is how long before its expiry the certificate is
+	// renewed
+	renewBefore = 30 * 24 * time.Hour
+	// defaultPropagationDelay is the time waited for the records to be
+	// visible when the configuration doesn't set it
+	defaultPropagationDelay = 30 * time.Second
+)
+
+// dnsManager obtains a certificate for all the hosts from an ACME
+// authority, answering the DNS-01 challenges, and renews it before it
+// expires.
+type dnsManager struct {
+	conf     *metaimport.ACMEConfig
+	cache    autocert.DirCache
+	provider dnsProvider
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+}
+
+// newDNSManager returns a manager configured by conf, holding the
+// certificate of the cache. A new one is obtained if it's missing or
+// about to expire and it's renewed in the background. It fails only if
+// there is no certificate to serve.
+func newDNSManager(conf *metaimport.ACMEConfig) (*dnsManager, error) {
+	provider, err := newDNSProvider(conf.DNS)
+	if err != nil {
+		return nil, fmt.Errorf("acme: %s", err)
+	}
+	m := &dnsManager{conf: conf, cache: autocert.DirCache(conf.Cache), provider: provider}
+	ctx := context.Background()
+	if data, err := m.cache.Get(ctx, dnsCertKey); err == nil {
+		cert, err := parseCert(data)
+		if err != nil {
+			slog.Warn("ignoring the cached certificate", "err", err)
+		} else if m.matches(cert) {
+			m.cert = cert
+		}
+	} else if err != autocert.ErrCacheMiss {
+		return nil, fmt.Errorf("acme: %s", err)
+	}
+	if m.expiring() {
+		if err := m.obtain(ctx); err != nil {
+			if m.cert == nil {
+				return nil, err
+			}
+			// The cached certificate is still valid, its renewal is
+			// retried later
+			slog.Error("failed to renew the certificate", "err", err)
+		}
+	}
+	go m.renew()
+	return m, nil
+}
+
+// parseCert parses the private key followed by the chain, PEM encoded,
+// of a certificate.
+func parseCert(data []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+// matches reports whether cert has been issued for the hosts of m.
+func (m *dnsManager) matches(cert *tls.Certificate) bool {
+	names := map[string]bool{}
+	for _, name := range cert.Leaf.DNSNames {
+		names[name] = true
+	}
+	for _, host := range m.conf.Hosts {
+		if !names[host] {
+			return false
+		}
+	}
+	return true
+}
+
+// expiring reports whether the certificate of m is missing or about to
+// expire.
+func (m *dnsManager) expiring() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cert == nil || time.Until(m.cert.Leaf.NotAfter) < renewBefore
+}
+
+// renew renews the certificate of m when it's about to expire.
+func (m *dnsManager) renew() {
+	for range time.Tick(renewCheckInterval) {
+		if !m.expiring() {
+			continue
+		}
+		if err := m.obtain(context.Background()); err != nil {
+			slog.Error("failed to renew the certificate", "err", err)
+		}
+	}
+}
+
+// GetCertificate returns the certificate of m, whatever the server name
+// of hello.
+func (m *dnsManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, errors.New("acme: no certificate")
+	}
+	return m.cert, nil
+}
+
+// account returns the key of the account, generated and stored in the
+// cache the first time.
+func (m *dnsManager) account(ctx context.Context) (crypto.Signer, error) {
+	data, err := m.cache.Get(ctx, accountKey)
+	if err == nil {
+		b, _ := pem.Decode(data)
+		if b == nil || b.Type != "EC PRIVATE KEY" {
+			return nil, errors.New("invalid account key")
+		}
+		return x509.ParseECPrivateKey(b.Bytes)
+	}
+	if err != autocert.ErrCacheMiss {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := m.cache.Put(ctx, accountKey, data); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// obtain obtains a new certificate for the hosts of m and stores it in
+// the cache.
+func (m *dnsManager) obtain(ctx context.Context) error {
+	slog.Info("obtaining a certificate", "hosts", m.conf.Hosts)
+	if err := m.order(ctx); err != nil {
+		return fmt.Errorf("acme: %s", err)
+	}
+	slog.Info("certificate obtained", "hosts", m.conf.Hosts)
+	return nil
+}
+
+// order orders the certificate of obtain.
+func (m *dnsManager) order(ctx context.Context) error {
+	key, err := m.account(ctx)
+	if err != nil {
+		return err
+	}
+	client := &acme.Client{Key: key, DirectoryURL: m.conf.DirectoryURL}
+	acct := &acme.Account{}
+	if m.conf.Email != "" {
+		acct.Contact = []string{"mailto:" + m.conf.Email}
+	}
+	if _, err := client.Register(ctx, acct, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return err
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(m.conf.Hosts...))
+	if err != nil {
+		return err
+	}
+	var pending []*acme.Challenge
+	for _, u := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, u)
+		if err != nil {
+			return err
+		}
+		if authz.Status != acme.StatusPending {
+			continue
+		}
+		var chal *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == "dns-01" {
+				chal = c
+			}
+		}
+		if chal == nil {
+			return fmt.Errorf("no dns-01 challenge for %s", authz.Identifier.Value)
+		}
+		value, err := client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return err
+		}
+		name := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.") + "."
+		if err := m.provider.present(ctx, name, value); err != nil {
+			return err
+		}
+		defer func() {
+			if err := m.provider.cleanup(context.Background(), name, value); err != nil {
+				slog.Warn("failed to remove the record of the challenge", "name", name, "err", err)
+			}
+		}()
+		pending = append(pending, chal)
+	}
+	if len(pending) > 0 {
+		delay := time.Duration(m.conf.DNS.PropagationDelay)
+		if delay == 0 {
+			delay = defaultPropagationDelay
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for _, chal := range pending {
+		if _, err := client.Accept(ctx, chal); err != nil {
+			return err
+		}
+	}
+	for _, u := range order.AuthzURLs {
+		if _, err := client.WaitAuthorization(ctx, u); err != nil {
+			return err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return err
+	}
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: m.conf.Hosts}, certKey)
+	if err != nil {
+		return err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	for _, c := range chain {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: c})
+	}
+	cert, err := parseCert(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := m.cache.Put(ctx, dnsCertKey, buf.Bytes()); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.cert = cert
+	m.mu.Unlock()
+	return nil
+}
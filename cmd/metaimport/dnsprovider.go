@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/montag451/metaimport"
+)
+
+// dnsProvider creates and removes the TXT records of the DNS-01
+// challenges.
+type dnsProvider interface {
+	// present creates the TXT record fqdn holding value
+	present(ctx context.Context, fqdn, value string) error
+	// cleanup removes the TXT record fqdn holding value
+	cleanup(ctx context.Context, fqdn, value string) error
+}
+
+// newDNSProvider returns the provider configured by conf.
+func newDNSProvider(conf *metaimport.DNSChallengeConfig) (dnsProvider, error) {
+	switch conf.Provider {
+	case "exec":
+		if len(conf.Command) == 0 {
+			return nil, errors.New("missing command")
+		}
+		return execProvider(conf.Command), nil
+	case "rfc2136":
+		p := &rfc2136Provider{nameserver: conf.Nameserver, zone: fqdn(conf.Zone), key: conf.TSIGKey}
+		if p.key == "" {
+			return p, nil
+		}
+		secret, err := base64.StdEncoding.DecodeString(conf.TSIGSecret)
+		if err != nil {
+			return nil, fmt.Errorf("bad tsig secret: %s", err)
+		}
+		p.secret = secret
+		switch conf.TSIGAlgorithm {
+		case "hmac-sha1":
+			p.alg, p.hash = "hmac-sha1.", sha1.New
+		case "", "hmac-sha256":
+			p.alg, p.hash = "hmac-sha256.", sha256.New
+		case "hmac-sha512":
+			p.alg, p.hash = "hmac-sha512.", sha512.New
+		default:
+			return nil, fmt.Errorf("unknown tsig algorithm %q", conf.TSIGAlgorithm)
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown dns provider %q", conf.Provider)
+}
+
+// fqdn returns name, fully qualified.
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// execProvider runs a command to create and remove the records, with
+// the arguments present or cleanup, the name of the record and its
+// value.
+type execProvider []string
+
+func (p execProvider) run(ctx context.Context, action, fqdn, value string) error {
+	args := append(p[1:len(p):len(p)], action, fqdn, value)
+	out, err := exec.CommandContext(ctx, p[0], args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %s: %s", p[0], action, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (p execProvider) present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+func (p execProvider) cleanup(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+// The values used in the DNS messages.
+const (
+	dnsTypeTXT   = 16
+	dnsTypeSOA   = 6
+	dnsTypeTSIG  = 250
+	dnsClassIN   = 1
+	dnsClassNone = 254
+	dnsClassAny  = 255
+	dnsOpUpdate  = 5
+	// challengeTTL is the TTL of the records of the challenges
+	challengeTTL = 60
+	// tsigFudge is the time difference, in seconds, allowed between
+	// the clocks
+	tsigFudge = 300
+)
+
+// rfc2136Provider creates and removes the records with dynamic updates
+// (RFC 2136) sent to a name server, signed with TSIG (RFC 8945) if a
+// key is given.
+type rfc2136Provider struct {
+	nameserver string
+	zone       string
+	key        string
+	alg        string
+	hash       func() hash.Hash
+	secret     []byte
+}
+
+func (p *rfc2136Provider) present(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, dnsClassIN, challengeTTL)
+}
+
+func (p *rfc2136Provider) cleanup(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, dnsClassNone, 0)
+}
+
+// appendName appends the domain name name, in wire format and not
+// compressed, to b.
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// appendRR appends a resource record to b.
+func appendRR(b []byte, name string, typ, class uint16, ttl uint32, rdata []byte) []byte {
+	b = appendName(b, name)
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, class)
+	b = binary.BigEndian.AppendUint32(b, ttl)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+	return append(b, rdata...)
+}
+
+// update adds, if class is IN, or deletes, if class is NONE, the TXT
+// record fqdn holding value.
+func (p *rfc2136Provider) update(ctx context.Context, fqdn, value string, class uint16, ttl uint32) error {
+	var id [2]byte
+	rand.Read(id[:])
+	msg := append([]byte{}, id[:]...)
+	msg = append(msg, dnsOpUpdate<<3, 0)
+	// One zone, no prerequisite, one update and no additional record
+	msg = append(msg, 0, 1, 0, 0, 0, 1, 0, 0)
+	msg = appendName(msg, p.zone)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeSOA)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	msg = appendRR(msg, fqdn, dnsTypeTXT, class, ttl, append([]byte{byte(len(value))}, value...))
+	if p.key != "" {
+		msg = p.sign(msg, time.Now())
+	}
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "udp", p.nameserver)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	resp := make([]byte, 512)
+	for {
+		n, err := conn.Read(resp)
+		if err != nil {
+			return err
+		}
+		if n < 12 || resp[0] != id[0] || resp[1] != id[1] {
+			continue
+		}
+		if rcode := resp[3] & 0xf; rcode != 0 {
+			return fmt.Errorf("update of %s refused by %s with rcode %d", fqdn, p.nameserver, rcode)
+		}
+		return nil
+	}
+}
+
+// sign appends the TSIG record signing msg at t and returns the signed
+// message.
+func (p *rfc2136Provider) sign(msg []byte, t time.Time) []byte {
+	var timeSigned [6]byte
+	sec := uint64(t.Unix())
+	for i := range timeSigned {
+		timeSigned[i] = byte(sec >> (8 * (5 - i)))
+	}
+	// The variables of the TSIG record covered by the MAC
+	vars := appendName(nil, p.key)
+	vars = binary.BigEndian.AppendUint16(vars, dnsClassAny)
+	vars = binary.BigEndian.AppendUint32(vars, 0)
+	vars = appendName(vars, p.alg)
+	vars = append(vars, timeSigned[:]...)
+	vars = binary.BigEndian.AppendUint16(vars, tsigFudge)
+	// No error and no other data
+	vars = append(vars, 0, 0, 0, 0)
+	mac := hmac.New(p.hash, p.secret)
+	mac.Write(msg)
+	mac.Write(vars)
+	sum := mac.Sum(nil)
+	rdata := appendName(nil, p.alg)
+	rdata = append(rdata, timeSigned[:]...)
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = append(rdata, msg[0], msg[1], 0, 0, 0, 0)
+	msg = appendRR(msg, p.key, dnsTypeTSIG, dnsClassAny, 0, rdata)
+	// One additional record, the TSIG one
+	binary.BigEndian.PutUint16(msg[10:], 1)
+	return msg
+}
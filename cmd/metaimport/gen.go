@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/montag451/metaimport"
+)
+
+// genRepo is a repository found by a generator. Name is the path of
+// the repository relative to the organization, which is appended to
+// the prefix to build the import path. Forge is the forge preset used
+// to build the go-source meta tag, if any.
+type genRepo struct {
+	Name  string
+	URL   string
+	VCS   string
+	Forge string
+}
+
+// A generator registers its flags in fs and returns a function
+// listing the repositories.
+type generator struct {
+	desc  string
+	setup func(fs *flag.FlagSet) func() ([]genRepo, error)
+}
+
+var generators = map[string]*generator{
+	"github":    {"list the repositories of a GitHub organization", githubGenerator},
+	"gitlab":    {"list the projects of a GitLab group and its subgroups", gitlabGenerator},
+	"gitea":     {"list the repositories of Gitea or Forgejo organizations", giteaGenerator},
+	"bitbucket": {"list the repositories of a Bitbucket Cloud workspace or Data Center project", bitbucketGenerator},
+}
+
+var genClient = &http.Client{Timeout: 30 * time.Second}
+
+var linkNextRegexp = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// getPages fetches all the pages of a JSON list, starting at next. Each
+// page is passed to decode, which returns the URL of the next page if
+// it's given by the body, the next link of the Link header is followed
+// otherwise.
+func getPages(next string, header http.Header, decode func(*json.Decoder) (string, error)) error {
+	for next != "" {
+		req, err := http.NewRequest(http.MethodGet, next, nil)
+		if err != nil {
+			return err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := genClient.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("failed to fetch %s: %s", next, resp.Status)
+		}
+		cur := next
+		next, err = decode(json.NewDecoder(resp.Body))
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("bad response from %s: %s", cur, err)
+		}
+		if next != "" {
+			continue
+		}
+		if m := linkNextRegexp.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+			next = m[1]
+		}
+	}
+	return nil
+}
+
+func githubGenerator(fs *flag.FlagSet) func() ([]genRepo, error) {
+	org := fs.String("org", "", "GitHub organization")
+	baseURL := fs.String("base-url", "https://api.github.com", "base URL of the GitHub API")
+	token := fs.String("token", os.Getenv("GITHUB_TOKEN"), "GitHub token, defaults to $GITHUB_TOKEN")
+	archived := fs.Bool("archived", false, "include archived repositories")
+	forks := fs.Bool("forks", false, "include forked repositories")
+	return func() ([]genRepo, error) {
+		if *org == "" {
+			return nil, fmt.Errorf("-org is required")
+		}
+		header := http.Header{"Accept": {"application/vnd.github+json"}}
+		if *token != "" {
+			header.Set("Authorization", "Bearer "+*token)
+		}
+		var repos []genRepo
+		u := strings.TrimSuffix(*baseURL, "/") + "/orgs/" + url.PathEscape(*org) + "/repos?per_page=100"
+		err := getPages(u, header, func(d *json.Decoder) (string, error) {
+			var page []struct {
+				Name     string
+				CloneURL string `json:"clone_url"`
+				Archived bool
+				Fork     bool
+			}
+			if err := d.Decode(&page); err != nil {
+				return "", err
+			}
+			for _, r := range page {
+				if (r.Archived && !*archived) || (r.Fork && !*forks) {
+					continue
+				}
+				repos = append(repos, genRepo{r.Name, r.CloneURL, "git", "github"})
+			}
+			return "", nil
+		})
+		return repos, err
+	}
+}
+
+func gitlabGenerator(fs *flag.FlagSet) func() ([]genRepo, error) {
+	group := fs.String("group", "", "full path of the GitLab group")
+	baseURL := fs.String("base-url", "https://gitlab.com", "base URL of the GitLab instance")
+	token := fs.String("token", os.Getenv("GITLAB_TOKEN"), "GitLab token, defaults to $GITLAB_TOKEN")
+	archived := fs.Bool("archived", false, "include archived projects")
+	return func() ([]genRepo, error) {
+		if *group == "" {
+			return nil, fmt.Errorf("-group is required")
+		}
+		header := http.Header{}
+		if *token != "" {
+			header.Set("PRIVATE-TOKEN", *token)
+		}
+		q := url.Values{
+			"include_subgroups": {"true"},
+			"per_page":          {"100"},
+		}
+		if !*archived {
+			q.Set("archived", "false")
+		}
+		g := strings.Trim(*group, "/")
+		u := strings.TrimSuffix(*baseURL, "/") + "/api/v4/groups/" + url.PathEscape(g) + "/projects?" + q.Encode()
+		var repos []genRepo
+		err := getPages(u, header, func(d *json.Decoder) (string, error) {
+			var page []struct {
+				PathWithNamespace string `json:"path_with_namespace"`
+				HTTPURLToRepo     string `json:"http_url_to_repo"`
+			}
+			if err := d.Decode(&page); err != nil {
+				return "", err
+			}
+			for _, p := range page {
+				// Subgroups become components of the import path
+				name := strings.TrimPrefix(p.PathWithNamespace, g+"/")
+				repos = append(repos, genRepo{name, p.HTTPURLToRepo, "git", "gitlab"})
+			}
+			return "", nil
+		})
+		return repos, err
+	}
+}
+
+func giteaGenerator(fs *flag.FlagSet) func() ([]genRepo, error) {
+	org := fs.String("org", "", "organization, all the organizations when empty")
+	baseURL := fs.String("base-url", "", "base URL of the Gitea or Forgejo instance")
+	token := fs.String("token", os.Getenv("GITEA_TOKEN"), "access token, defaults to $GITEA_TOKEN")
+	archived := fs.Bool("archived", false, "include archived repositories")
+	forks := fs.Bool("forks", false, "include forked repositories")
+	return func() ([]genRepo, error) {
+		if *baseURL == "" {
+			return nil, fmt.Errorf("-base-url is required")
+		}
+		header := http.Header{}
+		if *token != "" {
+			header.Set("Authorization", "token "+*token)
+		}
+		api := strings.TrimSuffix(*baseURL, "/") + "/api/v1"
+		orgs := []string{*org}
+		if *org == "" {
+			orgs = nil
+			err := getPages(api+"/orgs?limit=50", header, func(d *json.Decoder) (string, error) {
+				var page []struct{ Username string }
+				if err := d.Decode(&page); err != nil {
+					return "", err
+				}
+				for _, o := range page {
+					orgs = append(orgs, o.Username)
+				}
+				return "", nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		var repos []genRepo
+		for _, o := range orgs {
+			u := api + "/orgs/" + url.PathEscape(o) + "/repos?limit=50"
+			err := getPages(u, header, func(d *json.Decoder) (string, error) {
+				var page []struct {
+					Name     string
+					CloneURL string `json:"clone_url"`
+					Archived bool
+					Fork     bool
+				}
+				if err := d.Decode(&page); err != nil {
+					return "", err
+				}
+				for _, r := range page {
+					if (r.Archived && !*archived) || (r.Fork && !*forks) {
+						continue
+					}
+					name := r.Name
+					if *org == "" {
+						// The organization becomes a component
+						// of the import path
+						name = o + "/" + name
+					}
+					repos = append(repos, genRepo{name, r.CloneURL, "git", "gitea"})
+				}
+				return "", nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return repos, nil
+	}
+}
+
+// cloneURL returns the clone URL href without the user name that
+// Bitbucket puts in it.
+func cloneURL(href string) string {
+	u, err := url.Parse(href)
+	if err != nil {
+		return href
+	}
+	u.User = nil
+	return u.String()
+}
+
+func bitbucketGenerator(fs *flag.FlagSet) func() ([]genRepo, error) {
+	workspace := fs.String("workspace", "", "Bitbucket Cloud workspace")
+	project := fs.String("project", "", "Bitbucket Data Center project key, requires -base-url")
+	baseURL := fs.String("base-url", "", "base URL of the Bitbucket Data Center instance or of the Bitbucket Cloud API")
+	user := fs.String("user", os.Getenv("BITBUCKET_USERNAME"), "user name used with an app password, defaults to $BITBUCKET_USERNAME")
+	token := fs.String("token", os.Getenv("BITBUCKET_TOKEN"), "app password or access token, defaults to $BITBUCKET_TOKEN")
+	return func() ([]genRepo, error) {
+		header := http.Header{}
+		switch {
+		case *token != "" && *user != "":
+			auth := base64.StdEncoding.EncodeToString([]byte(*user + ":" + *token))
+			header.Set("Authorization", "Basic "+auth)
+		case *token != "":
+			header.Set("Authorization", "Bearer "+*token)
+		}
+		var repos []genRepo
+		switch {
+		case *workspace != "":
+			api := "https://api.bitbucket.org"
+			if *baseURL != "" {
+				api = strings.TrimSuffix(*baseURL, "/")
+			}
+			u := api + "/2.0/repositories/" + url.PathEscape(*workspace) + "?pagelen=100"
+			err := getPages(u, header, func(d *json.Decoder) (string, error) {
+				var page struct {
+					Values []struct {
+						Slug  string
+						SCM   string
+						Links struct {
+							Clone []struct{ Name, Href string }
+						}
+					}
+					Next string
+				}
+				if err := d.Decode(&page); err != nil {
+					return "", err
+				}
+				for _, r := range page.Values {
+					for _, c := range r.Links.Clone {
+						if c.Name == "https" {
+							repos = append(repos, genRepo{r.Slug, cloneURL(c.Href), r.SCM, "bitbucket"})
+						}
+					}
+				}
+				return page.Next, nil
+			})
+			return repos, err
+		case *project != "" && *baseURL != "":
+			api := strings.TrimSuffix(*baseURL, "/") + "/rest/api/1.0/projects/" + url.PathEscape(*project) + "/repos?limit=100"
+			err := getPages(api, header, func(d *json.Decoder) (string, error) {
+				var page struct {
+					Values []struct {
+						Slug  string
+						SCMID string `json:"scmId"`
+						Links struct {
+							Clone []struct{ Name, Href string }
+						}
+					}
+					IsLastPage    bool
+					NextPageStart int
+				}
+				if err := d.Decode(&page); err != nil {
+					return "", err
+				}
+				for _, r := range page.Values {
+					for _, c := range r.Links.Clone {
+						if c.Name == "http" {
+							// The browse URLs of Data Center don't
+							// derive from the clone URL
+							repos = append(repos, genRepo{r.Slug, cloneURL(c.Href), r.SCMID, ""})
+						}
+					}
+				}
+				if page.IsLastPage {
+					return "", nil
+				}
+				return api + "&start=" + strconv.Itoa(page.NextPageStart), nil
+			})
+			return repos, err
+		default:
+			return nil, fmt.Errorf("-workspace or -project and -base-url are required")
+		}
+	}
+}
+
+func genUsage(fs *flag.FlagSet) {
+	fmt.Fprintf(fs.Output(), "usage: %s gen GENERATOR [flags]\n\ngenerators:\n", os.Args[0])
+	names := make([]string, 0, len(generators))
+	for name := range generators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(fs.Output(), "  %-10s %s\n", name, generators[name].desc)
+	}
+}
+
+func genCommand(fs *flag.FlagSet, args []string) {
+	if len(args) == 0 || generators[args[0]] == nil {
+		genUsage(fs)
+		os.Exit(2)
+	}
+	prefix := fs.String("prefix", "", "prefix of the generated import paths, e.g. go.example.com")
+	format := fs.String("format", "json", "output format: json, yaml or toml")
+	list := generators[args[0]].setup(fs)
+	fs.Parse(args[1:])
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *prefix == "" {
+		log.Fatal("-prefix is required")
+	}
+	repos, err := list()
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Name < repos[j].Name })
+	conf := &metaimport.Config{}
+	for _, r := range repos {
+		conf.Paths = append(conf.Paths, metaimport.ImportPath{
+			Prefix:       strings.TrimSuffix(*prefix, "/") + "/" + r.Name,
+			VCS:          r.VCS,
+			RepoTemplate: escapeTemplate(r.URL),
+			Forge:        r.Forge,
+		})
+	}
+	if err := encodeConfig(os.Stdout, conf, *format); err != nil {
+		log.Fatal(err)
+	}
+}
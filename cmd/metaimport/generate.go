@@ -0,0 +1,194 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/montag451/metaimport"
+)
+
+// generateSite renders the page of each import path of conf under
+// domain into dir, so that it can be served by a static web server.
+// The pages are the landing pages served by metaimport.Handler, which
+// hold the meta tags read by the go command as well, or the pages
+// served to the go command if the browsers are redirected. Import
+// paths whose repository depends on the package name can't be
+// generated and are skipped. The index page listing the import paths
+// is generated at the root, unless an import path is served there,
+// along with the sitemap, robots.txt and the well-known files. The
+// favicon and the static assets are copied.
+func generateSite(conf *metaimport.Config, domain, dir string) error {
+	domain, err := configDomain(conf, domain)
+	if err != nil {
+		return err
+	}
+	h, err := metaimport.New(conf)
+	if err != nil {
+		return err
+	}
+	root := false
+	for i, p := range conf.Paths {
+		if p.Regexp != "" {
+			log.Printf("path %d (%s): matched by a regexp, skipping it", i, p.Regexp)
+			continue
+		}
+		components := strings.Split(p.Prefix, "/")
+		if components[0] != domain {
+			continue
+		}
+		if p.NbComponents != len(components) {
+			log.Printf("path %d (%s): repository depends on the package name, skipping it", i, p.Prefix)
+			continue
+		}
+		mi, err := h.Resolver().Resolve(p.Prefix)
+		if err != nil {
+			return fmt.Errorf("path %d (%s): %s", i, p.Prefix, err)
+		}
+		if mi.Index != i {
+			// Shadowed by another import path
+			continue
+		}
+		req := httptest.NewRequest(http.MethodGet, "http://"+p.Prefix, nil)
+		req.Header.Set("Accept", "text/html")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code == http.StatusFound {
+			// A static site can't redirect the browsers, fall
+			// back to the page served to the go command
+			log.Printf("path %d (%s): browsers can't be redirected, skipping the landing page", i, p.Prefix)
+			req = httptest.NewRequest(http.MethodGet, "http://"+p.Prefix+"?go-get=1", nil)
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+		}
+		if w.Code != http.StatusOK {
+			return fmt.Errorf("path %d (%s): %s", i, p.Prefix, http.StatusText(w.Code))
+		}
+		if err := writePage(dir, components[1:], w.Body.Bytes()); err != nil {
+			return err
+		}
+		if len(components) == 1 {
+			root = true
+		}
+	}
+	for _, file := range []string{"sitemap.xml", "robots.txt"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://"+domain+"/"+file, nil))
+		if w.Code != http.StatusOK {
+			return fmt.Errorf("%s: %s", file, http.StatusText(w.Code))
+		}
+		name := filepath.Join(dir, file)
+		if err := ioutil.WriteFile(name, w.Body.Bytes(), 0644); err != nil {
+			return err
+		}
+		log.Printf("generated %s", name)
+	}
+	if len(conf.WellKnown) > 0 {
+		if err := os.MkdirAll(filepath.Join(dir, ".well-known"), 0755); err != nil {
+			return err
+		}
+	}
+	for file, content := range conf.WellKnown {
+		name := filepath.Join(dir, ".well-known", filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			return err
+		}
+		log.Printf("generated %s", name)
+	}
+	if conf.Favicon != "" {
+		if err := copyFile(conf.Favicon, filepath.Join(dir, "favicon.ico")); err != nil {
+			return err
+		}
+	}
+	if conf.Static != "" {
+		if err := copyDir(conf.Static, filepath.Join(dir, "-", "static")); err != nil {
+			return err
+		}
+	}
+	if root {
+		return nil
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://"+domain+"/", nil))
+	if w.Code != http.StatusOK {
+		return fmt.Errorf("index: %s", http.StatusText(w.Code))
+	}
+	return writePage(dir, nil, w.Body.Bytes())
+}
+
+// writePage writes the page served at the given path components into
+// dir.
+func writePage(dir string, components []string, page []byte) error {
+	name := filepath.Join(append([]string{dir}, components...)...)
+	if err := os.MkdirAll(name, 0755); err != nil {
+		return err
+	}
+	name = filepath.Join(name, "index.html")
+	if err := ioutil.WriteFile(name, page, 0644); err != nil {
+		return err
+	}
+	log.Printf("generated %s", name)
+	return nil
+}
+
+func generateCommand(fs *flag.FlagSet, args []string) {
+	out := fs.String("o", ".", "output directory")
+	domain := fs.String("domain", "", "domain of the generated import paths, required when there are several")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	conf, err := metaimport.LoadConfig(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := generateSite(conf, *domain, *out); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// copyFile copies the file src to dst.
+func copyFile(src, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(dst, data, 0644); err != nil {
+		return err
+	}
+	log.Printf("generated %s", dst)
+	return nil
+}
+
+// copyDir copies the regular files of the directory src and of its
+// subdirectories to dst.
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, name)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0755)
+		case d.Type().IsRegular():
+			return copyFile(name, target)
+		}
+		return nil
+	})
+}
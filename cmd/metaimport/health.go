@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/montag451/metaimport"
+)
+
+// healthzHandler tells the liveness probes that the process is alive.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok\n")
+}
+
+// readyz tells the readiness probes whether s is ready to serve the
+// requests: its configuration has been loaded and compiled and the
+// database of the statistics, if any, can be read.
+func (s *server) readyz(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.current.Load().(*metaimport.Handler); !ok {
+		http.Error(w, "configuration not loaded", http.StatusServiceUnavailable)
+		return
+	}
+	if err := s.stats.Check(); err != nil {
+		http.Error(w, "statistics database: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
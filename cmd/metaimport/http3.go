@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// serveHTTP3 serves with handler the HTTP/3 requests received over QUIC
+// on the UDP addresses addrs and returns a handler passing the requests
+// to handler and advertising HTTP/3, on the port the request has been
+// received on, with the Alt-Svc header.
+func serveHTTP3(addrs []string, conf *tls.Config, handler http.Handler) http.Handler {
+	// The servers by port, the listeners on all the addresses
+	// receiving connections on any of them
+	servers := map[string]*http3.Server{}
+	for _, addr := range addrs {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		srv := &http3.Server{
+			Addr:      addr,
+			Handler:   handler,
+			TLSConfig: http3.ConfigureTLSConfig(conf),
+		}
+		servers[port] = srv
+		c, err := listenPacket(addr)
+		if err != nil {
+			fatal("failed to serve HTTP/3", err)
+		}
+		go func() {
+			fatal("failed to serve HTTP/3", srv.Serve(c))
+		}()
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			_, port, _ := net.SplitHostPort(addr.String())
+			if srv := servers[port]; srv != nil {
+				srv.SetQUICHeaders(w.Header())
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// stdioAddr is the address of the ends of the standard input and output
+// when they are not a socket.
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+// stdioConn is a connection reading from the standard input and writing
+// to the standard output, e.g. pipes when run by ssh.
+type stdioConn struct {
+	in  *os.File
+	out *os.File
+}
+
+func (c stdioConn) Read(b []byte) (int, error)  { return c.in.Read(b) }
+func (c stdioConn) Write(b []byte) (int, error) { return c.out.Write(b) }
+func (c stdioConn) LocalAddr() net.Addr         { return stdioAddr{} }
+func (c stdioConn) RemoteAddr() net.Addr        { return stdioAddr{} }
+
+func (c stdioConn) Close() error {
+	c.out.Close()
+	return c.in.Close()
+}
+
+// The deadlines are not supported by all the files, e.g. terminals,
+// they are then ignored
+func (c stdioConn) SetDeadline(t time.Time) error {
+	c.in.SetDeadline(t)
+	c.out.SetDeadline(t)
+	return nil
+}
+
+func (c stdioConn) SetReadDeadline(t time.Time) error {
+	c.in.SetReadDeadline(t)
+	return nil
+}
+
+func (c stdioConn) SetWriteDeadline(t time.Time) error {
+	c.out.SetWriteDeadline(t)
+	return nil
+}
+
+// stdioListener is a listener returning a single connection, the one
+// on the standard input and output. The socket inherited from inetd is
+// used directly so that the address of the client is known.
+type stdioListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+// newStdioListener returns a listener returning the connection on the
+// standard input and output.
+func newStdioListener() *stdioListener {
+	l := &stdioListener{closed: make(chan struct{})}
+	if c, err := net.FileConn(os.Stdin); err == nil {
+		// The connection holds a duplicate of the file descriptor,
+		// which would otherwise keep the connection open
+		os.Stdin.Close()
+		os.Stdout.Close()
+		l.conn = c
+	} else {
+		l.conn = stdioConn{os.Stdin, os.Stdout}
+	}
+	l.conn = &onCloseConn{Conn: l.conn, fn: l.Close}
+	return l
+}
+
+// Accept returns the connection the first time it's called. It then
+// blocks until the connection is closed, the server then stops.
+func (l *stdioListener) Accept() (net.Conn, error) {
+	if c := l.conn; c != nil {
+		l.conn = nil
+		return c, nil
+	}
+	<-l.closed
+	return nil, io.EOF
+}
+
+func (l *stdioListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *stdioListener) Addr() net.Addr {
+	return stdioAddr{}
+}
+
+// onCloseConn is a connection calling fn when it's closed.
+type onCloseConn struct {
+	net.Conn
+	fn func() error
+}
+
+func (c *onCloseConn) Close() error {
+	err := c.Conn.Close()
+	c.fn()
+	return err
+}
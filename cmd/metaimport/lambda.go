@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// lambdaAPIVersion is the version of the runtime API of AWS Lambda.
+const lambdaAPIVersion = "2018-06-01"
+
+// lambdaEvent is an event sent by API Gateway, as a REST API (payload
+// version 1.0) or an HTTP API (payload version 2.0), or by an
+// application load balancer.
+type lambdaEvent struct {
+	Version string `json:"version"`
+	// Version 1.0 and load balancer
+	HTTPMethod        string              `json:"httpMethod"`
+	Path              string              `json:"path"`
+	Query             map[string]string   `json:"queryStringParameters"`
+	MultiValueQuery   map[string][]string `json:"multiValueQueryStringParameters"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders"`
+	// Version 2.0
+	RawPath        string   `json:"rawPath"`
+	RawQueryString string   `json:"rawQueryString"`
+	Cookies        []string `json:"cookies"`
+	// All the versions
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+	RequestContext  struct {
+		DomainName string `json:"domainName"`
+		HTTP       struct {
+			Method   string `json:"method"`
+			SourceIP string `json:"sourceIp"`
+		} `json:"http"`
+		Identity struct {
+			SourceIP string `json:"sourceIp"`
+		} `json:"identity"`
+		ELB *struct{} `json:"elb"`
+	} `json:"requestContext"`
+}
+
+// lambdaResponse is the response to a lambdaEvent.
+type lambdaResponse struct {
+	StatusCode        int                 `json:"statusCode"`
+	StatusDescription string              `json:"statusDescription,omitempty"`
+	Headers           map[string]string   `json:"headers,omitempty"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders,omitempty"`
+	Cookies           []string            `json:"cookies,omitempty"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+// request returns the HTTP request of e.
+func (e *lambdaEvent) request() (*http.Request, error) {
+	body := []byte(e.Body)
+	if e.IsBase64Encoded {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(e.Body); err != nil {
+			return nil, err
+		}
+	}
+	method, path, query, ip := e.HTTPMethod, e.Path, "", e.RequestContext.Identity.SourceIP
+	if e.Version == "2.0" {
+		method, path, query, ip = e.RequestContext.HTTP.Method, e.RawPath, e.RawQueryString, e.RequestContext.HTTP.SourceIP
+	} else if len(e.MultiValueQuery) > 0 {
+		query = url.Values(e.MultiValueQuery).Encode()
+	} else if len(e.Query) > 0 {
+		v := url.Values{}
+		for name, value := range e.Query {
+			v.Set(name, value)
+		}
+		query = v.Encode()
+	}
+	u := &url.URL{Path: path, RawQuery: query}
+	r, err := http.NewRequest(method, u.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range e.MultiValueHeaders {
+		for _, v := range values {
+			r.Header.Add(name, v)
+		}
+	}
+	for name, value := range e.Headers {
+		if r.Header.Get(name) == "" {
+			r.Header.Set(name, value)
+		}
+	}
+	for _, c := range e.Cookies {
+		r.Header.Add("Cookie", c)
+	}
+	r.Host = r.Header.Get("Host")
+	if r.Host == "" {
+		r.Host = e.RequestContext.DomainName
+	}
+	if ip != "" {
+		r.RemoteAddr = net.JoinHostPort(ip, "0")
+	}
+	return r, nil
+}
+
+// lambdaRecorder is the http.ResponseWriter recording the response to
+// an event.
+type lambdaRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *lambdaRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *lambdaRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *lambdaRecorder) Write(b []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(b)
+}
+
+// response returns the response recorded by rec to the event e.
+func (rec *lambdaRecorder) response(e *lambdaEvent) *lambdaResponse {
+	resp := &lambdaResponse{StatusCode: rec.status}
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+	if utf8.Valid(rec.body.Bytes()) {
+		resp.Body = rec.body.String()
+	} else {
+		resp.Body = base64.StdEncoding.EncodeToString(rec.body.Bytes())
+		resp.IsBase64Encoded = true
+	}
+	if e.RequestContext.ELB != nil {
+		resp.StatusDescription = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+	}
+	switch {
+	case e.Version == "2.0":
+		resp.Headers = map[string]string{}
+		for name, values := range rec.header {
+			if name == "Set-Cookie" {
+				resp.Cookies = values
+				continue
+			}
+			resp.Headers[name] = strings.Join(values, ", ")
+		}
+	case len(e.MultiValueHeaders) > 0 || e.RequestContext.ELB == nil:
+		resp.MultiValueHeaders = rec.header
+	default:
+		// A load balancer without multi-value headers enabled
+		resp.Headers = map[string]string{}
+		for name := range rec.header {
+			resp.Headers[name] = rec.header.Get(name)
+		}
+	}
+	return resp
+}
+
+// serveLambda serves with handler the events received from the runtime
+// API of AWS Lambda listening on api, until it fails.
+func serveLambda(api string, handler http.Handler) error {
+	base := "http://" + api + "/" + lambdaAPIVersion + "/runtime/invocation/"
+	for {
+		resp, err := http.Get(base + "next")
+		if err != nil {
+			return err
+		}
+		id := resp.Header.Get("Lambda-Runtime-Aws-Request-Id")
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("lambda: next invocation: %s", resp.Status)
+		}
+		var result any
+		path := "/response"
+		e := &lambdaEvent{}
+		var r *http.Request
+		if err = json.Unmarshal(data, e); err == nil {
+			r, err = e.request()
+		}
+		if err != nil {
+			path = "/error"
+			result = map[string]string{"errorMessage": err.Error(), "errorType": "InvalidEvent"}
+		} else {
+			rec := &lambdaRecorder{header: http.Header{}}
+			handler.ServeHTTP(rec, r)
+			result = rec.response(e)
+		}
+		body, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		resp, err = http.Post(base+id+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			return fmt.Errorf("lambda: %s of %s: %s", path[1:], id, resp.Status)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// connLimiter limits the connections served at once, shared by all the
+// listeners of the server.
+type connLimiter struct {
+	// sem holds a value for each connection served, nil if their
+	// number is not limited
+	sem   chan struct{}
+	perIP int
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+// newConnLimiter returns a limiter serving at most max connections at
+// once, at most perIP of them from the same IP address, no limit being
+// set by a value lower than or equal to zero.
+func newConnLimiter(max, perIP int) *connLimiter {
+	cl := &connLimiter{perIP: perIP, conns: map[string]int{}}
+	if max > 0 {
+		cl.sem = make(chan struct{}, max)
+	}
+	return cl
+}
+
+// listener returns a listener accepting the connections of l within the
+// limits of cl. The connections beyond the limit per IP address are
+// closed as soon as they are accepted, the other ones wait to be
+// accepted until one is closed.
+func (cl *connLimiter) listener(l net.Listener) net.Listener {
+	return &limitListener{Listener: l, cl: cl}
+}
+
+// acquire reports whether the connection from ip can be served, ip
+// being empty when the connection has no IP address.
+func (cl *connLimiter) acquire(ip string) bool {
+	if cl.perIP <= 0 || ip == "" {
+		return true
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.conns[ip] >= cl.perIP {
+		return false
+	}
+	cl.conns[ip]++
+	return true
+}
+
+// release releases the connection from ip acquired with acquire.
+func (cl *connLimiter) release(ip string) {
+	if cl.perIP <= 0 || ip == "" {
+		return
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.conns[ip]--; cl.conns[ip] <= 0 {
+		delete(cl.conns, ip)
+	}
+}
+
+// releaseSlot releases a connection counted by the limit of all the
+// connections.
+func (cl *connLimiter) releaseSlot() {
+	if cl.sem != nil {
+		<-cl.sem
+	}
+}
+
+// limitListener is a listener whose connections are limited by a
+// connLimiter.
+type limitListener struct {
+	net.Listener
+	cl *connLimiter
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		if l.cl.sem != nil {
+			l.cl.sem <- struct{}{}
+		}
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.cl.releaseSlot()
+			return nil, err
+		}
+		ip := ""
+		if a, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+			ip = a.IP.String()
+		}
+		if !l.cl.acquire(ip) {
+			c.Close()
+			l.cl.releaseSlot()
+			continue
+		}
+		return &limitConn{Conn: c, cl: l.cl, ip: ip}, nil
+	}
+}
+
+// limitConn is a connection accepted by a limitListener, released when
+// it's closed.
+type limitConn struct {
+	net.Conn
+	cl   *connLimiter
+	ip   string
+	once sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		c.cl.release(c.ip)
+		c.cl.releaseSlot()
+	})
+	return err
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/montag451/metaimport"
+)
+
+const (
+	// defaultSocketMode is the mode of the Unix domain sockets when the
+	// configuration doesn't set it
+	defaultSocketMode = 0666
+	// listenFdsStart is the first file descriptor passed by systemd
+	listenFdsStart = 3
+)
+
+// listenAddrs returns the addresses the server configured by conf
+// listens on.
+func listenAddrs(conf *metaimport.Config) []string {
+	if len(conf.Listen) > 0 {
+		return conf.Listen
+	}
+	return []string{net.JoinHostPort(conf.Host, strconv.FormatUint(uint64(conf.Port), 10))}
+}
+
+// listenAll returns the listeners on addrs, as returned by listen.
+func listenAll(addrs []string, mode string) ([]net.Listener, error) {
+	var ls []net.Listener
+	for _, addr := range addrs {
+		l, err := listen(addr, mode)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// listen returns a listener on addr, a TCP address or the path of a
+// Unix domain socket prefixed with unix:, whose mode is then set to
+// mode, in octal. The listener is the one inherited from the upgraded
+// process if any and is passed to the new process when upgrading.
+func listen(addr, mode string) (net.Listener, error) {
+	if f := inheritedSocket(addr); f != nil {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("bad socket inherited for %s: %s", addr, err)
+		}
+		// The socket is now the one of the process, which removes it
+		// when it stops
+		if l, ok := l.(*net.UnixListener); ok {
+			l.SetUnlinkOnClose(true)
+		}
+		keepSocket(addr, l.(socket))
+		return l, nil
+	}
+	l, err := listenNew(addr, mode)
+	if err != nil {
+		return nil, err
+	}
+	keepSocket(addr, l.(socket))
+	return l, nil
+}
+
+// listenNew returns a new listener on addr, as described by listen.
+func listenNew(addr, mode string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	perm := uint64(defaultSocketMode)
+	if mode != "" {
+		var err error
+		if perm, err = strconv.ParseUint(mode, 8, 32); err != nil {
+			return nil, err
+		}
+	}
+	// The socket left by a server which has not been stopped cleanly
+	// would prevent the new one from listening
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// listenPacket returns a UDP socket on addr, the one inherited from the
+// upgraded process if any, passed to the new process when upgrading.
+func listenPacket(addr string) (net.PacketConn, error) {
+	key := "udp/" + addr
+	var c net.PacketConn
+	var err error
+	if f := inheritedSocket(key); f != nil {
+		c, err = net.FilePacketConn(f)
+		f.Close()
+	} else {
+		c, err = net.ListenPacket("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	keepSocket(key, c.(socket))
+	return c, nil
+}
+
+// activationListeners returns the sockets passed by systemd with socket
+// activation, or inherited from the upgraded process which got them
+// from systemd, nil if there are none.
+func activationListeners() ([]net.Listener, error) {
+	var ls []net.Listener
+	for i := 0; ; i++ {
+		key := "systemd/" + strconv.Itoa(i)
+		f := inheritedSocket(key)
+		if f == nil {
+			break
+		}
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("bad socket inherited for %s: %s", key, err)
+		}
+		keepSocket(key, l.(socket))
+		ls = append(ls, l)
+	}
+	if len(ls) > 0 {
+		return ls, nil
+	}
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	// The children must not believe the sockets are theirs
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		// The listener holds a duplicate of the file descriptor
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("bad socket passed by systemd: %s", err)
+		}
+		keepSocket("systemd/"+strconv.Itoa(fd-listenFdsStart), l.(socket))
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// stdinListener returns the listening socket passed as the standard
+// input, as done by the web servers starting the FastCGI applications,
+// nil if the standard input is not one. The one inherited from the
+// upgraded process, which got it as its standard input, is returned if
+// any.
+func stdinListener() net.Listener {
+	f := inheritedSocket("stdin")
+	if f == nil {
+		f = os.Stdin
+	}
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil
+	}
+	f.Close()
+	keepSocket("stdin", l.(socket))
+	return l
+}
+
+// listenAndServe listens on addr, as done by listen, and serves with
+// handler the HTTP requests received in the background, exiting with
+// the message msg if it fails. It returns once it listens, so that the
+// privileges can be dropped.
+func listenAndServe(addr string, handler http.Handler, msg string) error {
+	l, err := listen(addr, "")
+	if err != nil {
+		return err
+	}
+	go func() {
+		fatal(msg, http.Serve(l, handler))
+	}()
+	return nil
+}
+
+// listenerAddr returns the address l listens on, written as in the
+// configuration.
+func listenerAddr(l net.Listener) string {
+	if a, ok := l.Addr().(*net.UnixAddr); ok {
+		return "unix:" + a.Name
+	}
+	return l.Addr().String()
+}
+
+// writeAddrs writes the addresses the listeners ls listen on, one per
+// line, to the file name.
+func writeAddrs(name string, ls []net.Listener) error {
+	var b strings.Builder
+	for _, l := range ls {
+		b.WriteString(listenerAddr(l) + "\n")
+	}
+	// The file is renamed so that it's never seen partially written
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/montag451/metaimport"
+)
+
+// backupTimeFormat is the format of the time appended to the name of
+// the rotated log files.
+const backupTimeFormat = "20060102T150405.000"
+
+// logFile is a log file rotated when it's too big or too old. The
+// rotated files are renamed by appending the time of their rotation to
+// their name, then compressed and pruned in the background.
+type logFile struct {
+	mu      sync.Mutex
+	name    string
+	maxSize int64
+	maxAge  time.Duration
+	backups int
+	gzip    bool
+	f       *os.File
+	size    int64
+	opened  time.Time
+}
+
+// openLogFile opens the log file configured by conf.
+func openLogFile(conf *metaimport.LogConfig) (*logFile, error) {
+	l := &logFile{
+		name:    conf.File,
+		maxSize: int64(conf.MaxSize) << 20,
+		maxAge:  time.Duration(conf.MaxAge),
+		backups: conf.MaxBackups,
+		gzip:    conf.Compress,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the log file, creating it if needed.
+func (l *logFile) open() error {
+	f, err := os.OpenFile(l.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size, l.opened = f, fi.Size(), time.Now()
+	return nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tooBig := l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize
+	tooOld := l.maxAge > 0 && time.Since(l.opened) >= l.maxAge
+	if tooBig || tooOld {
+		if err := l.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rotate %s: %v\n", l.name, err)
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate renames the log file and opens a new one. If the rename
+// fails, the messages are still appended to the current file.
+func (l *logFile) rotate() error {
+	backup := l.name + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(l.name, backup); err != nil {
+		return err
+	}
+	l.f.Close()
+	if err := l.open(); err != nil {
+		return err
+	}
+	go l.cleanup(backup)
+	return nil
+}
+
+// cleanup compresses the rotated file backup, if the file is to be
+// compressed, and removes the oldest rotated files.
+func (l *logFile) cleanup(backup string) {
+	if l.gzip {
+		if err := compressFile(backup); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to compress %s: %v\n", backup, err)
+		}
+	}
+	if l.backups <= 0 {
+		return
+	}
+	names, err := filepath.Glob(l.name + ".*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, name := range names {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(name, l.name+"."), ".gz")
+		if _, err := time.Parse(backupTimeFormat, suffix); err == nil {
+			backups = append(backups, name)
+		}
+	}
+	// The time format sorts the rotated files from the oldest
+	sort.Strings(backups)
+	for len(backups) > l.backups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// compressFile replaces the file name by its gzip compressed version,
+// with the .gz extension.
+func compressFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
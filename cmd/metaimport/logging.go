@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/montag451/metaimport"
+)
+
+// setupLogging makes the default logger write to the standard error,
+// to the log file or to the syslog daemon, the messages at the level
+// and in the format given by conf, at the info level and as text if
+// conf is nil.
+func setupLogging(conf *metaimport.LogConfig) error {
+	opts := &slog.HandlerOptions{}
+	if conf == nil {
+		conf = &metaimport.LogConfig{}
+	}
+	if conf.Level != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(conf.Level)); err != nil {
+			return fmt.Errorf("log: %s", err)
+		}
+		opts.Level = level
+	}
+	var w io.Writer = os.Stderr
+	var sw *syslogWriter
+	switch {
+	case conf.Syslog != nil:
+		var err error
+		if sw, err = newSyslogWriter(conf.Syslog); err != nil {
+			return fmt.Errorf("log: %s", err)
+		}
+		w = sw
+		// The daemon timestamps the messages
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		}
+	case conf.File != "":
+		f, err := openLogFile(conf)
+		if err != nil {
+			return fmt.Errorf("log: %s", err)
+		}
+		w = f
+	}
+	var h slog.Handler
+	switch conf.Format {
+	case "", "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("log: unknown format %q", conf.Format)
+	}
+	h = &requestIDHandler{h}
+	if sw != nil {
+		h = &syslogHandler{Handler: h, w: sw}
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// requestIDHandler adds the ID of the request being served, if any, to
+// the records handled by the embedded handler.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h *requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := metaimport.RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *requestIDHandler) WithGroup(name string) slog.Handler {
+	return &requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// fatal logs msg with the error err and exits, removing the PID file.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	if overrides.pidFile != "" {
+		removePIDFile(overrides.pidFile)
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,480 @@
+// Command metaimport serves the go-import meta tags of vanity import
+// paths. It also provides commands to check the configuration and to
+// convert it from and to the ones of other tools.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/montag451/metaimport"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func resolveCommand(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	conf, err := metaimport.LoadConfig(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	resolver, err := metaimport.NewResolver(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pkgName := fs.Arg(1)
+	mi, err := resolver.Resolve(pkgName)
+	if err == metaimport.ErrNoMatch {
+		log.Fatalf("unable to match package %q", pkgName)
+	}
+	if err != nil {
+		log.Fatalf("failed to execute template for %q: %v", pkgName, err)
+	}
+	fmt.Printf("path:   %d (%s)\n", mi.Index, conf.Paths[mi.Index].Prefix)
+	fmt.Printf("prefix: %s\n", mi.Prefix)
+	fmt.Printf("vcs:    %s\n", mi.VCS)
+	fmt.Printf("repo:   %s\n", mi.Repo)
+	if mi.Source != nil {
+		fmt.Printf("home:   %s\n", mi.Source.Home)
+		fmt.Printf("dir:    %s\n", mi.Source.Directory)
+		fmt.Printf("file:   %s\n", mi.Source.File)
+	}
+}
+
+type command struct {
+	name string
+	args string
+	desc string
+	run  func(fs *flag.FlagSet, args []string)
+}
+
+var commands = []*command{
+	{"serve", "CONF_FILE|CONF_DIR|CONF_URL", "serve the import paths of the configuration", serveCommand},
+	{"check", "CONF_FILE|CONF_DIR|CONF_URL", "check the configuration", checkCommand},
+	{"resolve", "CONF_FILE|CONF_DIR|CONF_URL PACKAGE", "print how a package is resolved", resolveCommand},
+	{"lint", "CONF_FILE|CONF_DIR|CONF_URL", "check the configuration and report suspicious import paths", lintCommand},
+	{"convert", "govanityurls VANITY_YAML", "convert a configuration from another tool", convertCommand},
+	{"export", "vangen CONF_FILE|CONF_DIR|CONF_URL", "export the configuration for another tool", exportCommand},
+	{"generate", "CONF_FILE|CONF_DIR|CONF_URL", "generate a static site serving the import paths", generateCommand},
+	{"gen", "GENERATOR", "generate import paths from the repositories of a forge", genCommand},
+	{"schema", "", "print the JSON schema of the configuration", schemaCommand},
+	{"version", "", "print the version", versionCommand},
+}
+
+// newFlagSet returns the flag set of the command cmd.
+func newFlagSet(cmd *command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s [flags] %s\n\n%s\n", os.Args[0], cmd.name, cmd.args, cmd.desc)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s COMMAND [flags] [args]\n\ncommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.desc)
+	}
+	os.Exit(2)
+}
+
+// defaultShutdownTimeout is the time given to the requests in progress
+// to complete when the server is stopped and the configuration doesn't
+// set it.
+const defaultShutdownTimeout = 30 * time.Second
+
+const (
+	// defaultReadHeaderTimeout is the maximum time to read the headers
+	// of a request when the configuration doesn't set it
+	defaultReadHeaderTimeout = 10 * time.Second
+	// defaultIdleTimeout is the maximum time to wait for the next
+	// request on a connection when the configuration doesn't set it
+	defaultIdleTimeout = 2 * time.Minute
+)
+
+// server serves the current version of the configuration.
+type server struct {
+	current atomic.Value // *metaimport.Handler
+	stats   *metaimport.Stats
+	metrics *metaimport.Metrics
+	tracer  *metaimport.Tracer
+	// acme is the manager of the certificates obtained by answering
+	// HTTP-01 or TLS-ALPN-01 challenges, nil if they're not
+	acme *autocert.Manager
+}
+
+// update replaces the handler of s with one serving conf, after having
+// applied the command line overrides and reported the problems found
+// in it. The handler is kept if conf has errors.
+func (s *server) update(conf *metaimport.Config) error {
+	overrides.apply(conf)
+	h, err := metaimport.New(conf)
+	if err != nil {
+		return err
+	}
+	h.Stats = s.stats
+	h.Metrics = s.metrics
+	h.Tracer = s.tracer
+	h.WrapHandler = s.wrap
+	if conf.AccessLog != "none" {
+		h.AccessLog = os.Stdout
+		if overrides.inetd {
+			// The standard output is the connection
+			h.AccessLog = os.Stderr
+		}
+	}
+	if err := report(conf); err != nil {
+		return err
+	}
+	s.current.Store(h)
+	return nil
+}
+
+// wrap returns a handler serving the endpoints of the server, e.g. its
+// metrics, and passing the other requests to next. They are wrapped by
+// the handler so that the ACL, the rate limits and the headers of the
+// configuration apply to them too. The methods other than GET and HEAD
+// are passed to next, which rejects them.
+func (s *server) wrap(next http.Handler) http.Handler {
+	// The default mux is not used as net/http/pprof registers its
+	// handlers on it
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /-/version", versionHandler)
+	mux.Handle("GET /-/metrics", s.metrics)
+	mux.HandleFunc("GET /-/healthz", healthzHandler)
+	mux.HandleFunc("GET /-/readyz", s.readyz)
+	mux.Handle("/", next)
+	return mux
+}
+
+// reload replaces the configuration with the new version conf.
+func (s *server) reload(conf *metaimport.Config) {
+	notifyReloading()
+	defer notify("READY=1")
+	if err := s.update(conf); err != nil {
+		slog.Error("failed to reload configuration", "err", err)
+		return
+	}
+	slog.Info("configuration reloaded")
+}
+
+// reloadOnSignal reloads the configuration name each time the process
+// receives SIGHUP.
+func (s *server) reloadOnSignal(name string) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		slog.Info("reloading configuration", "name", name)
+		conf, err := metaimport.LoadConfig(name)
+		if err != nil {
+			slog.Error("failed to reload configuration", "name", name, "err", err)
+			continue
+		}
+		s.reload(conf)
+	}
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.current.Load().(*metaimport.Handler).ServeHTTP(w, r)
+}
+
+// settings holds the settings given on the command line, which take
+// precedence over the ones of the configuration.
+type settings struct {
+	host, cert, key string
+	port            uint
+	devTLS          bool
+	inetd           bool
+	fcgi            bool
+	addrFile        string
+	pidFile         string
+	set             map[string]bool
+}
+
+var overrides settings
+
+func (o *settings) apply(conf *metaimport.Config) {
+	// The port to listen on is given by Cloud Run
+	if port, err := strconv.ParseUint(os.Getenv("PORT"), 10, 16); err == nil && !o.set["port"] {
+		conf.Port = uint16(port)
+		conf.Listen = nil
+	}
+	if o.set["host"] || o.set["port"] {
+		conf.Listen = nil
+	}
+	if o.set["host"] {
+		conf.Host = o.host
+	}
+	if o.set["port"] {
+		conf.Port = uint16(o.port)
+	}
+	if o.set["cert"] || o.set["key"] {
+		t := metaimport.TLSConfig{}
+		if conf.Tls != nil {
+			t = *conf.Tls
+		}
+		if o.set["cert"] {
+			t.Cert = o.cert
+		}
+		if o.set["key"] {
+			t.PrivKey = o.key
+		}
+		conf.Tls = &t
+	}
+}
+
+func serveCommand(fs *flag.FlagSet, args []string) {
+	fs.StringVar(&overrides.host, "host", "", "address to listen on, overrides the configuration")
+	fs.UintVar(&overrides.port, "port", 0, "port to listen on, overrides the configuration")
+	fs.StringVar(&overrides.cert, "cert", "", "TLS certificate file, overrides the configuration")
+	fs.StringVar(&overrides.key, "key", "", "TLS private key file, overrides the configuration")
+	fs.BoolVar(&overrides.inetd, "inetd", false, "serve a single connection on the standard input and output, e.g. when run by inetd, and write the access log records to the standard error")
+	fs.BoolVar(&overrides.fcgi, "fcgi", false, "serve FastCGI rather than HTTP, on the socket passed as the standard input by the web server if there is one, e.g. Apache with mod_fcgid, the TLS settings being ignored")
+	fs.StringVar(&overrides.addrFile, "addr-file", "", "file the addresses listened on are written to, one per line, e.g. to find the port chosen when it's 0")
+	fs.StringVar(&overrides.pidFile, "pidfile", "", "file the PID of the server is written to, removed when it stops")
+	fs.BoolVar(&overrides.devTLS, "dev-tls", false, "serve TLS with a self-signed certificate generated for the hosts of the import paths, overrides the TLS settings of the configuration, for the tests only")
+	fs.Parse(args)
+	overrides.set = map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		overrides.set[f.Name] = true
+	})
+	if overrides.port > math.MaxUint16 {
+		log.Fatalf("invalid port %d", overrides.port)
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	// The sockets must be taken before anything listens
+	ready := loadInheritedSockets()
+	name := fs.Arg(0)
+	conf, err := metaimport.LoadConfig(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := setupLogging(conf.Log); err != nil {
+		log.Fatal(err)
+	}
+	s := &server{stats: metaimport.NewStats(), metrics: metaimport.NewMetrics()}
+	if conf.Tracing != nil {
+		s.tracer = metaimport.NewTracer(conf.Tracing)
+	}
+	if c := conf.Stats; c != nil && c.Database != "" {
+		if s.stats, err = metaimport.OpenStats(c.Database); err != nil {
+			fatal("failed to open the statistics", err)
+		}
+		go s.stats.Persist(time.Duration(c.FlushInterval), time.Duration(c.Retention))
+	}
+	if err := s.update(conf); err != nil {
+		fatal("failed to load configuration", err)
+	}
+	go s.reloadOnSignal(name)
+	if err := metaimport.Watch(name, conf, s.reload); err != nil {
+		fatal("failed to watch configuration", err)
+	}
+	if conf.Pprof != nil {
+		if err := servePprof(conf.Pprof); err != nil {
+			fatal("failed to serve the profiles", err)
+		}
+	}
+	// The runtime API is given to the functions run by AWS Lambda
+	if api := os.Getenv("AWS_LAMBDA_RUNTIME_API"); api != "" {
+		fatal("failed to serve the Lambda events", serveLambda(api, s))
+	}
+	var ls []net.Listener
+	if overrides.inetd {
+		ls = []net.Listener{newStdioListener()}
+	} else if overrides.fcgi {
+		if l := stdinListener(); l != nil {
+			ls = []net.Listener{l}
+		}
+	}
+	if ls == nil {
+		if ls, err = activationListeners(); ls == nil && err == nil {
+			ls, err = listenAll(listenAddrs(conf), conf.SocketMode)
+		}
+	}
+	if err != nil {
+		fatal("failed to listen", err)
+	}
+	for _, l := range ls {
+		slog.Info("listening", "addr", listenerAddr(l))
+	}
+	if overrides.addrFile != "" {
+		if err := writeAddrs(overrides.addrFile, ls); err != nil {
+			fatal("failed to write the addresses", err)
+		}
+	}
+	if overrides.pidFile != "" {
+		if err := writePIDFile(overrides.pidFile); err != nil {
+			fatal("failed to write the PID file", err)
+		}
+	}
+	// The HTTPS requests are sent to the first TCP port listened on
+	// when they are redirected
+	var tcpAddrs []string
+	port := conf.Port
+	limiter := newConnLimiter(conf.MaxConns, conf.MaxConnsPerIP)
+	for i, l := range ls {
+		if a, ok := l.Addr().(*net.TCPAddr); ok {
+			if len(tcpAddrs) == 0 {
+				port = uint16(a.Port)
+			}
+			tcpAddrs = append(tcpAddrs, a.String())
+		}
+		if conf.MaxConns > 0 || conf.MaxConnsPerIP > 0 {
+			ls[i] = limiter.listener(l)
+		}
+		if conf.ProxyProtocol {
+			ls[i] = &proxyListener{Listener: ls[i], trusted: func(ip net.IP) bool {
+				return s.current.Load().(*metaimport.Handler).Config().TrustsProxyProtocol(ip)
+			}}
+		}
+	}
+	srv := &http.Server{
+		Handler:           s,
+		ReadTimeout:       time.Duration(conf.ReadTimeout),
+		ReadHeaderTimeout: time.Duration(conf.ReadHeaderTimeout),
+		WriteTimeout:      time.Duration(conf.WriteTimeout),
+		IdleTimeout:       time.Duration(conf.IdleTimeout),
+		MaxHeaderBytes:    conf.MaxHeaderBytes,
+	}
+	if srv.ReadHeaderTimeout <= 0 {
+		srv.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if srv.IdleTimeout <= 0 {
+		srv.IdleTimeout = defaultIdleTimeout
+	}
+	var serve func(l net.Listener) error
+	switch {
+	case overrides.fcgi:
+		serve = func(l net.Listener) error {
+			return fcgi.Serve(l, s)
+		}
+	case overrides.devTLS:
+		if srv.TLSConfig, err = devTLSConfig(conf); err != nil {
+			fatal("failed to generate the certificate", err)
+		}
+		serve = func(l net.Listener) error {
+			return srv.ServeTLS(l, "", "")
+		}
+	case conf.Tls == nil:
+		if conf.H2C {
+			srv.Handler = h2c.NewHandler(s, &http2.Server{})
+		}
+		serve = srv.Serve
+	default:
+		if srv.TLSConfig, err = s.tlsConfig(conf.Tls); err != nil {
+			fatal("failed to configure TLS", err)
+		}
+		if conf.Tls.HTTP3 {
+			srv.Handler = serveHTTP3(tcpAddrs, srv.TLSConfig, s)
+		}
+		if addr := conf.Tls.RedirectAddr; addr != "" {
+			if err := listenAndServe(addr, s.redirectHandler(port), "failed to serve the redirects"); err != nil {
+				fatal("failed to serve the redirects", err)
+			}
+		}
+		serve = func(l net.Listener) error {
+			// The certificate is given by the TLS configuration
+			return srv.ServeTLS(l, "", "")
+		}
+	}
+	// Everything is listened on, the privileges are no longer needed
+	if conf.User != "" {
+		if err := dropPrivileges(conf.User, conf.Group); err != nil {
+			fatal("failed to drop the privileges", err)
+		}
+	}
+	errs := make(chan error, len(ls))
+	for _, l := range ls {
+		go func() {
+			errs <- serve(l)
+		}()
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	// The upgraded process stops once the new one serves
+	reportReady(ready)
+	notify("READY=1")
+	select {
+	case err := <-errs:
+		if !(overrides.inetd && err == io.EOF) {
+			fatal("failed to serve", err)
+		}
+	case sig := <-s.upgradeOnSignal(signals):
+		timeout := time.Duration(conf.ShutdownTimeout)
+		if timeout <= 0 {
+			timeout = defaultShutdownTimeout
+		}
+		slog.Info("shutting down", "signal", sig.String(), "timeout", timeout)
+		// The new process is the main one of the service once upgraded
+		if sig != syscall.SIGUSR2 {
+			notify("STOPPING=1")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if overrides.fcgi {
+			// The FastCGI requests in progress are not waited for
+			for _, l := range ls {
+				l.Close()
+			}
+		} else if err := srv.Shutdown(ctx); err != nil {
+			slog.Warn("failed to complete the requests in progress", "err", err)
+		}
+	}
+	if err := s.stats.Close(); err != nil {
+		slog.Error("failed to write the statistics", "err", err)
+	}
+	if overrides.pidFile != "" {
+		removePIDFile(overrides.pidFile)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	args := os.Args[1:]
+	var cmd *command
+	for _, c := range commands {
+		if c.name == args[0] {
+			cmd = c
+			args = args[1:]
+			break
+		}
+	}
+	switch {
+	case cmd != nil:
+	case args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help":
+		usage()
+	case args[0] == "-version" || args[0] == "--version":
+		fmt.Println(getVersion())
+		return
+	default:
+		// Keep supporting the invocation without a command, which
+		// used to be the only one
+		cmd = commands[0]
+	}
+	cmd.run(newFlagSet(cmd), args)
+}
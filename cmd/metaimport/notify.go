@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// notify sends the state to the service manager, as done by sd_notify.
+// It does nothing if the process has not been started by systemd with
+// a service of type notify.
+func notify(state string) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return
+	}
+	// The name of an abstract socket starts with @
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("failed to notify systemd", "err", err)
+		return
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte(state)); err != nil {
+		slog.Warn("failed to notify systemd", "err", err)
+	}
+}
+
+// notifyReloading notifies the service manager that the server is
+// reloading. The services of type notify-reload must give the time of
+// the reload, which the following READY=1 completes.
+func notifyReloading() {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		notify("RELOADING=1")
+		return
+	}
+	usec := ts.Nano() / 1000
+	notify("RELOADING=1\nMONOTONIC_USEC=" + strconv.FormatInt(usec, 10))
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// writePIDFile writes the PID of the process to the file name.
+func writePIDFile(name string) error {
+	// The file is renamed so that it's never seen partially written
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// removePIDFile removes the file name written by writePIDFile, unless
+// it has been replaced meanwhile, e.g. by the process started by an
+// upgrade.
+func removePIDFile(name string) {
+	data, err := os.ReadFile(name)
+	if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	os.Remove(name)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/montag451/metaimport"
+)
+
+// defaultPprofAddr is the address the profiles are served on when the
+// configuration doesn't say otherwise.
+const defaultPprofAddr = "localhost:6060"
+
+// isLoopback reports whether the address addr only listens on the
+// loopback interface.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// servePprof serves the profiles of net/http/pprof on their own
+// listener, as configured by conf. A token is required unless they are
+// only served on the loopback interface.
+func servePprof(conf *metaimport.PprofConfig) error {
+	addr := conf.Addr
+	if addr == "" {
+		addr = defaultPprofAddr
+	}
+	token := conf.Token
+	if token == "" && !isLoopback(addr) {
+		return fmt.Errorf("pprof: a token is required to listen on %s", addr)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	h := http.Handler(mux)
+	if token != "" {
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The token can be given as a parameter for go tool
+			// pprof, which can't send headers
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if got == "" {
+				got = r.URL.Query().Get("token")
+			}
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		})
+	}
+	l, err := listen(addr, "")
+	if err != nil {
+		return fmt.Errorf("pprof: %s", err)
+	}
+	slog.Info("serving the profiles", "addr", l.Addr().String())
+	go func() {
+		slog.Error("failed to serve the profiles", "err", http.Serve(l, h))
+	}()
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges makes the process run as the user name, given by name
+// or ID, and the group group, the primary group of the user when empty,
+// with the supplementary groups of the user. It does nothing if the
+// process already runs as the user, e.g. once it's been upgraded.
+func dropPrivileges(name, group string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return fmt.Errorf("unknown user %s", name)
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("user %s has no numeric ID", name)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if group != "" {
+		g, lerr := user.LookupGroup(group)
+		if lerr != nil {
+			if g, lerr = user.LookupGroupId(group); lerr != nil {
+				return fmt.Errorf("unknown group %s", group)
+			}
+		}
+		gid, err = strconv.Atoi(g.Gid)
+	}
+	if err != nil {
+		return fmt.Errorf("group of user %s has no numeric ID", name)
+	}
+	if os.Getuid() == uid && os.Getgid() == gid {
+		return nil
+	}
+	var groups []int
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if n, err := strconv.Atoi(id); err == nil && n != gid {
+				groups = append(groups, n)
+			}
+		}
+	}
+	// The group must be changed first, the user being no longer allowed
+	// to afterwards
+	if err := syscall.Setgroups(groups); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
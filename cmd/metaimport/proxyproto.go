@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout is the time within which the PROXY protocol header
+// must be received.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts the headers of the version 2 of the PROXY
+// protocol.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener accepts connections starting with a PROXY protocol
+// header, version 1 or 2, giving the address of the client. The
+// connections of the peers which are not trusted are served as they
+// are, under the address of the peer.
+type proxyListener struct {
+	net.Listener
+	// trusted reports whether the header sent by the peer ip is
+	// trusted
+	trusted func(ip net.IP) bool
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if a, ok := c.RemoteAddr().(*net.TCPAddr); ok && !l.trusted(a.IP) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyConn is a connection starting with a PROXY protocol header. The
+// header is read on the first use of the connection, not to block the
+// listener.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+// readHeader reads the PROXY protocol header of c.
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+	sig, err := c.r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		c.remote, c.err = readProxyV2(c.r)
+	} else {
+		c.remote, c.err = readProxyV1(c.r)
+	}
+	if c.err != nil {
+		c.err = fmt.Errorf("proxy protocol: %s", c.err)
+	}
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the address of the client given by the header,
+// the one of the peer if it gives none, e.g. for the health checks of
+// the load balancer.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyV1 reads a header of the version 1 of the PROXY protocol
+// from r and returns the address of the client.
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// The longest header is 107 bytes long
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("bad header")
+	}
+	fields := strings.Split(s, " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("bad header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("bad header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.New("bad source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a header of the version 2 of the PROXY protocol
+// from r and returns the address of the client.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unknown version %d", verCmd>>4)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	switch verCmd & 0xf {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unknown command %d", verCmd&0xf)
+	}
+	switch fam {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		if len(data) < 12 {
+			return nil, errors.New("short addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(data[:4]), Port: int(binary.BigEndian.Uint16(data[8:]))}, nil
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		if len(data) < 36 {
+			return nil, errors.New("short addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(data[:16]), Port: int(binary.BigEndian.Uint16(data[32:]))}, nil
+	}
+	// Unix sockets or unspecified, the address of the peer is used
+	return nil, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header returns a header of the version 2 of the PROXY protocol
+// with the command cmd, the family fam and the addresses addrs.
+func proxyV2Header(cmd, fam byte, addrs []byte) string {
+	hdr := append([]byte(nil), proxyV2Signature...)
+	hdr = append(hdr, 0x20|cmd, fam, byte(len(addrs)>>8), byte(len(addrs)))
+	return string(append(hdr, addrs...))
+}
+
+var (
+	// ipv4Addrs are the addresses of a header from 192.0.2.1:1234 to
+	// 192.0.2.2:443
+	ipv4Addrs = []byte{192, 0, 2, 1, 192, 0, 2, 2, 0x04, 0xd2, 0x01, 0xbb}
+	// ipv6Addrs are the addresses of a header from [2001:db8::1]:1234
+	// to [2001:db8::2]:443
+	ipv6Addrs = []byte{
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+		0x04, 0xd2, 0x01, 0xbb,
+	}
+)
+
+func TestReadProxyV1(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+		err    bool
+	}{
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 1234 443\r\n", "192.0.2.1:1234", false},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\n", "[2001:db8::1]:1234", false},
+		{"PROXY UNKNOWN\r\n", "", false},
+		{"PROXY UNKNOWN 192.0.2.1 192.0.2.2 1234 443\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 1234 443", "", true},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 1234 443\n", "", true},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2\r\n", "", true},
+		{"PROXY TCP4", "", true},
+		{"", "", true},
+		{"PROXY UDP4 192.0.2.1 192.0.2.2 1234 443\r\n", "", true},
+		{"PROXY TCP4 192.0.2 192.0.2.2 1234 443\r\n", "", true},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 123456 443\r\n", "", true},
+		{"GET / HTTP/1.1\r\n", "", true},
+		{"PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", "", true},
+	}
+	for _, test := range tests {
+		addr, err := readProxyV1(bufio.NewReader(strings.NewReader(test.header)))
+		if test.err {
+			if err == nil {
+				t.Errorf("readProxyV1(%q) = %v, want an error", test.header, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("readProxyV1(%q): %s", test.header, err)
+			continue
+		}
+		if got := addrString(addr); got != test.want {
+			t.Errorf("readProxyV1(%q) = %q, want %q", test.header, got, test.want)
+		}
+	}
+}
+
+func TestReadProxyV2(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+		err    bool
+	}{
+		{"ipv4", proxyV2Header(1, 0x11, ipv4Addrs), "192.0.2.1:1234", false},
+		{"ipv4 udp", proxyV2Header(1, 0x12, ipv4Addrs), "192.0.2.1:1234", false},
+		{"ipv6", proxyV2Header(1, 0x21, ipv6Addrs), "[2001:db8::1]:1234", false},
+		{"ipv4 with tlvs", proxyV2Header(1, 0x11, append(append([]byte(nil), ipv4Addrs...), 0x04, 0, 1, 0)), "192.0.2.1:1234", false},
+		{"local", proxyV2Header(0, 0, nil), "", false},
+		{"unix", proxyV2Header(1, 0x31, make([]byte, 216)), "", false},
+		{"unspecified", proxyV2Header(1, 0, nil), "", false},
+		{"truncated header", proxyV2Header(1, 0x11, ipv4Addrs)[:14], "", true},
+		{"truncated addresses", proxyV2Header(1, 0x11, ipv4Addrs)[:20], "", true},
+		{"short ipv4 addresses", proxyV2Header(1, 0x11, ipv4Addrs[:8]), "", true},
+		{"short ipv6 addresses", proxyV2Header(1, 0x21, ipv4Addrs), "", true},
+		{"bad version", "\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x00", "", true},
+		{"bad command", proxyV2Header(2, 0x11, ipv4Addrs), "", true},
+	}
+	for _, test := range tests {
+		addr, err := readProxyV2(bufio.NewReader(strings.NewReader(test.header)))
+		if test.err {
+			if err == nil {
+				t.Errorf("readProxyV2(%s) = %v, want an error", test.name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("readProxyV2(%s): %s", test.name, err)
+			continue
+		}
+		if got := addrString(addr); got != test.want {
+			t.Errorf("readProxyV2(%s) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// addrString returns the string form of addr, empty if it's nil.
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestProxyListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		trusted bool
+		// remote is the address of the client, the one of the peer
+		// if it's empty
+		remote string
+		body   string
+		err    bool
+	}{
+		{"v1", "PROXY TCP4 192.0.2.1 192.0.2.2 1234 443\r\nGET /", true, "192.0.2.1:1234", "GET /", false},
+		{"v2", proxyV2Header(1, 0x11, ipv4Addrs) + "GET /", true, "192.0.2.1:1234", "GET /", false},
+		{"health check", proxyV2Header(0, 0, nil) + "GET /", true, "", "GET /", false},
+		{"missing header", "GET / HTTP/1.1\r\n\r\n", true, "", "", true},
+		{"truncated header", "PROXY TCP4 192.0.2.1", true, "", "", true},
+		{"untrusted v1", "PROXY TCP4 192.0.2.1 192.0.2.2 1234 443\r\nGET /", false, "", "PROXY TCP4 192.0.2.1 192.0.2.2 1234 443\r\nGET /", false},
+		{"untrusted v2", proxyV2Header(1, 0x11, ipv4Addrs), false, "", proxyV2Header(1, 0x11, ipv4Addrs), false},
+	}
+	for _, test := range tests {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pl := &proxyListener{Listener: l, trusted: func(net.IP) bool { return test.trusted }}
+		peer := make(chan string, 1)
+		go func() {
+			c, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				peer <- ""
+				return
+			}
+			peer <- c.LocalAddr().String()
+			c.Write([]byte(test.data))
+			c.Close()
+		}()
+		c, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := test.remote
+		if want == "" {
+			want = <-peer
+		}
+		if got := c.RemoteAddr().String(); got != want {
+			t.Errorf("%s: RemoteAddr() = %s, want %s", test.name, got, want)
+		}
+		body, err := io.ReadAll(c)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: read %q, want an error", test.name, body)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if string(body) != test.body {
+			t.Errorf("%s: read %q, want %q", test.name, body, test.body)
+		}
+		c.Close()
+		l.Close()
+	}
+}
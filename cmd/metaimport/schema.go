@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/montag451/metaimport"
+)
+
+// The JSON schema of the configuration is generated from the
+// definition of the metaimport.Config type. The description of a setting is
+// given by the doc tag of its field and its default value by the
+// default tag. The schema tag holds a comma separated list of
+// constraints: required, minimum=N and maximum=N. The expansion of the
+// environment variables, applying to all the settings, is described at
+// the root of the schema.
+
+const schemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+var (
+	durationType  = reflect.TypeOf(metaimport.Duration(0))
+	addressesType = reflect.TypeOf(metaimport.Addresses(nil))
+)
+
+// configSchema returns the JSON schema describing the configuration.
+func configSchema() map[string]interface{} {
+	s := typeSchema(reflect.TypeOf(metaimport.Config{}))
+	s["$schema"] = schemaDraft
+	s["title"] = "metaimport configuration"
+	s["description"] = "The references to environment variables written as ${VAR} are expanded, ${VAR:-default} giving the value used when VAR is unset or empty, and $${ is written as a literal ${"
+	return s
+}
+
+// jsonName returns the name of the setting held by the field f.
+func jsonName(f reflect.StructField) string {
+	if name := strings.Split(f.Tag.Get("json"), ",")[0]; name != "" {
+		return name
+	}
+	return strings.ToLower(f.Name)
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t == durationType {
+		return map[string]interface{}{
+			"type":    "string",
+			"pattern": `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`,
+		}
+	}
+	if t == addressesType {
+		return map[string]interface{}{
+			"oneOf": []interface{}{
+				map[string]interface{}{"type": "string"},
+				map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			},
+		}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{
+			"type":    "integer",
+			"minimum": 0,
+			"maximum": uint64(1)<<uint(t.Bits()) - 1,
+		}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": typeSchema(t.Elem()),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": typeSchema(t.Elem()),
+		}
+	case reflect.Struct:
+		return structSchema(t)
+	}
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("json") == "-" {
+			continue
+		}
+		name := jsonName(f)
+		s := typeSchema(f.Type)
+		if doc := f.Tag.Get("doc"); doc != "" {
+			s["description"] = doc
+		}
+		if def, ok := f.Tag.Lookup("default"); ok {
+			var v interface{}
+			if err := json.Unmarshal([]byte(def), &v); err != nil {
+				v = def
+			}
+			s["default"] = v
+		}
+		for _, c := range strings.Split(f.Tag.Get("schema"), ",") {
+			k, v := c, ""
+			if i := strings.IndexByte(c, '='); i >= 0 {
+				k, v = c[:i], c[i+1:]
+			}
+			switch k {
+			case "required":
+				required = append(required, name)
+			case "minimum", "maximum":
+				n, _ := strconv.ParseFloat(v, 64)
+				s[k] = n
+			}
+		}
+		props[name] = s
+	}
+	s := map[string]interface{}{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func schemaCommand(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(configSchema()); err != nil {
+		log.Fatal(err)
+	}
+}
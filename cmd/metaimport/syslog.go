@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/montag451/metaimport"
+)
+
+// syslogWriter sends the messages written to it to a syslog daemon,
+// with the severity set before each write, reconnecting if the daemon
+// goes away.
+type syslogWriter struct {
+	mu       sync.Mutex
+	network  string
+	addr     string
+	facility int
+	tag      string
+	hostname string
+	severity int
+	conn     net.Conn
+}
+
+// newSyslogWriter returns a writer sending the messages to the syslog
+// daemon configured by conf.
+func newSyslogWriter(conf *metaimport.SyslogConfig) (*syslogWriter, error) {
+	w := &syslogWriter{
+		network:  conf.Network,
+		addr:     conf.Addr,
+		facility: conf.FacilityCode(),
+		tag:      conf.Tag,
+	}
+	if w.facility < 0 {
+		return nil, fmt.Errorf("unknown syslog facility %q", conf.Facility)
+	}
+	if w.network == "" {
+		w.network = "unix"
+	}
+	if w.addr == "" && w.network == "unix" {
+		w.addr = "/dev/log"
+	}
+	if w.tag == "" {
+		w.tag = "metaimport"
+	}
+	w.hostname, _ = os.Hostname()
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// connect connects w to the daemon. A unix socket is tried as a
+// datagram socket first, as most daemons expect.
+func (w *syslogWriter) connect() error {
+	if w.network != "unix" {
+		conn, err := net.DialTimeout(w.network, w.addr, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		w.conn = conn
+		return nil
+	}
+	conn, err := net.Dial("unixgram", w.addr)
+	if err != nil {
+		conn, err = net.Dial("unix", w.addr)
+	}
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+// Write sends the message p. It must be called with w.mu held.
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	pri := w.facility<<3 | w.severity
+	var line string
+	if w.network == "unix" {
+		line = fmt.Sprintf("<%d>%s %s[%d]: %s", pri, time.Now().Format(time.Stamp), w.tag, os.Getpid(), msg)
+	} else {
+		line = fmt.Sprintf("<%d>%s %s %s[%d]: %s", pri, time.Now().Format(time.RFC3339), w.hostname, w.tag, os.Getpid(), msg)
+	}
+	if w.network == "tcp" {
+		line += "\n"
+	}
+	var err error
+	for i := 0; i < 2; i++ {
+		if w.conn == nil {
+			if err = w.connect(); err != nil {
+				continue
+			}
+		}
+		if _, err = w.conn.Write([]byte(line)); err == nil {
+			return len(p), nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	return 0, err
+}
+
+// syslogSeverity returns the syslog severity of the level l.
+func syslogSeverity(l slog.Level) int {
+	switch {
+	case l >= slog.LevelError:
+		return 3 // err
+	case l >= slog.LevelWarn:
+		return 4 // warning
+	case l >= slog.LevelInfo:
+		return 6 // info
+	}
+	return 7 // debug
+}
+
+// syslogHandler sends the records formatted by the embedded handler,
+// which writes them to w, to the syslog daemon with the severity
+// matching their level.
+type syslogHandler struct {
+	slog.Handler
+	w *syslogWriter
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.w.mu.Lock()
+	defer h.w.mu.Unlock()
+	h.w.severity = syslogSeverity(r.Level)
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithAttrs(attrs), w: h.w}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{Handler: h.Handler.WithGroup(name), w: h.w}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/montag451/metaimport"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsConfig returns the TLS configuration of s configured by conf. The
+// certificate is either obtained from an ACME authority or loaded from
+// the configured files, which are reloaded when they're modified.
+func (s *server) tlsConfig(conf *metaimport.TLSConfig) (*tls.Config, error) {
+	c := &tls.Config{}
+	if err := conf.Apply(c); err != nil {
+		return nil, err
+	}
+	if conf.ACME == nil {
+		pairs := conf.Certs
+		if conf.Cert != "" {
+			pairs = append([]metaimport.CertPair{{Cert: conf.Cert, PrivKey: conf.PrivKey}}, pairs...)
+		}
+		if len(pairs) == 0 {
+			return nil, errors.New("tls: cert, certs or acme is required")
+		}
+		var certs certSet
+		for _, p := range pairs {
+			l, err := newCertLoader(p.Cert, p.PrivKey)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, l)
+		}
+		c.GetCertificate = certs.GetCertificate
+	} else if conf.ACME.DNS != nil {
+		m, err := newDNSManager(conf.ACME)
+		if err != nil {
+			return nil, err
+		}
+		c.GetCertificate = m.GetCertificate
+	} else {
+		m := s.acmeManager(conf.ACME)
+		s.acme = m
+		c.GetCertificate = m.GetCertificate
+		c.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		if addr := conf.ACME.HTTPAddr; addr != "" {
+			if err := listenAndServe(addr, m.HTTPHandler(nil), "failed to serve the ACME challenges"); err != nil {
+				return nil, fmt.Errorf("tls: %s", err)
+			}
+		}
+	}
+	if conf.ClientCA != "" {
+		pem, err := os.ReadFile(conf.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %s", err)
+		}
+		c.ClientCAs = x509.NewCertPool()
+		if !c.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: no certificate found in %s", conf.ClientCA)
+		}
+	}
+	switch conf.ClientAuth {
+	case "":
+		if c.ClientCAs != nil {
+			c.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	case "request":
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("tls: unknown client auth %q", conf.ClientAuth)
+	}
+	if c.ClientAuth != tls.NoClientCert && c.ClientCAs == nil {
+		return nil, errors.New("tls: client auth requires client_ca")
+	}
+	return c, nil
+}
+
+// acmeManager returns the manager of the certificates obtained as
+// configured by conf. If conf doesn't list the hosts, they are the ones
+// of the import paths of the current configuration.
+func (s *server) acmeManager(conf *metaimport.ACMEConfig) *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(conf.Cache),
+		Email:  conf.Email,
+	}
+	if conf.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: conf.DirectoryURL}
+	}
+	if len(conf.Hosts) > 0 {
+		m.HostPolicy = autocert.HostWhitelist(conf.Hosts...)
+	} else {
+		m.HostPolicy = func(ctx context.Context, host string) error {
+			for _, p := range s.current.Load().(*metaimport.Handler).Config().Paths {
+				if h, _, _ := strings.Cut(p.Prefix, "/"); h == host {
+					return nil
+				}
+			}
+			return fmt.Errorf("acme: no import path on host %q", host)
+		}
+	}
+	return m
+}
+
+// certLoader holds a certificate loaded from files, reloaded when they
+// are modified, e.g. when it has been renewed.
+type certLoader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+}
+
+// newCertLoader returns a loader of the certificate certFile and its
+// private key keyFile.
+func newCertLoader(certFile, keyFile string) (*certLoader, error) {
+	l := &certLoader{certFile: certFile, keyFile: keyFile}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	err := metaimport.WatchFiles([]string{certFile, keyFile}, func() {
+		if err := l.load(); err != nil {
+			// The files may be written one after the other, the
+			// previous certificate is kept until both match
+			slog.Warn("failed to reload the certificate", "cert", certFile, "err", err)
+			return
+		}
+		slog.Info("certificate reloaded", "cert", certFile)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("tls: %s", err)
+	}
+	return l, nil
+}
+
+// load loads the certificate of l.
+func (l *certLoader) load() error {
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.cert = &cert
+	l.mu.Unlock()
+	return nil
+}
+
+// certificate returns the certificate of l.
+func (l *certLoader) certificate() *tls.Certificate {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cert
+}
+
+// certSet holds the certificates the one sent to a client is selected
+// from.
+type certSet []*certLoader
+
+// GetCertificate returns the first certificate of s valid for the
+// server name of hello and supported by the client, the first one if
+// there are none.
+func (s certSet) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if len(s) == 0 {
+		return nil, errors.New("tls: no certificate")
+	}
+	for _, l := range s {
+		if cert := l.certificate(); hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return s[0].certificate(), nil
+}
+
+// devTLSConfig returns a TLS configuration holding a self-signed
+// certificate, generated for the hosts of the import paths of conf and
+// for the local host, so that the server can be tested with GOINSECURE
+// set.
+func devTLSConfig(conf *metaimport.Config) (*tls.Config, error) {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if conf.Host != "" {
+		hosts = append(hosts, conf.Host)
+	}
+	for _, p := range conf.Paths {
+		h, _, _ := strings.Cut(p.Prefix, "/")
+		if host, _, err := net.SplitHostPort(h); err == nil {
+			h = host
+		}
+		hosts = append(hosts, h)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"metaimport development"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	seen := map[string]bool{}
+	for _, h := range hosts {
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	slog.Warn("serving with a self-signed certificate", "hosts", tmpl.DNSNames, "ips", tmpl.IPAddresses)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, nil
+}
+
+// redirectHandler returns a handler redirecting the requests to the
+// HTTPS server listening on port, which also answers the HTTP-01
+// challenges if the certificates are obtained from an ACME authority.
+func (s *server) redirectHandler(port uint16) http.Handler {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+	if s.acme != nil {
+		return s.acme.HTTPHandler(h)
+	}
+	return h
+}
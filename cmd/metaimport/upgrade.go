@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// upgradeEnv is the environment variable giving to the new process
+	// the keys of the sockets it inherits, one per line, passed as the
+	// file descriptors following the standard error and followed by
+	// the pipe it reports it's ready on
+	upgradeEnv = "METAIMPORT_UPGRADE_SOCKETS"
+	// upgradeTimeout is the time given to the new process to be ready
+	upgradeTimeout = time.Minute
+)
+
+// socket is a socket whose file descriptor can be passed to another
+// process.
+type socket interface {
+	File() (*os.File, error)
+	SyscallConn() (syscall.RawConn, error)
+}
+
+// sockets holds the sockets of the process, passed to the new process
+// when upgrading, and the ones inherited from the upgraded process. The
+// sockets are identified by keys: the address for the listeners on the
+// addresses of the configuration, udp/ followed by the address for the
+// UDP sockets, systemd/ followed by their index for the ones passed by
+// systemd and stdin for the one passed as the standard input.
+var sockets struct {
+	mu        sync.Mutex
+	keys      []string
+	sockets   []socket
+	inherited map[string]*os.File
+}
+
+// keepSocket records s, identified by key, to pass it to the new
+// process when upgrading.
+func keepSocket(key string, s socket) {
+	sockets.mu.Lock()
+	defer sockets.mu.Unlock()
+	sockets.keys = append(sockets.keys, key)
+	sockets.sockets = append(sockets.sockets, s)
+}
+
+// inheritedSocket returns the file of the socket identified by key
+// inherited from the upgraded process, nil if there is none.
+func inheritedSocket(key string) *os.File {
+	sockets.mu.Lock()
+	defer sockets.mu.Unlock()
+	f := sockets.inherited[key]
+	delete(sockets.inherited, key)
+	return f
+}
+
+// loadInheritedSockets loads the sockets inherited from the upgraded
+// process and returns the pipe the readiness of the server must be
+// reported on, nil if the process has not been started by an upgrade.
+func loadInheritedSockets() *os.File {
+	v, ok := os.LookupEnv(upgradeEnv)
+	if !ok {
+		return nil
+	}
+	// The children must not believe the sockets are theirs
+	os.Unsetenv(upgradeEnv)
+	sockets.mu.Lock()
+	defer sockets.mu.Unlock()
+	sockets.inherited = map[string]*os.File{}
+	fd := 3
+	if v != "" {
+		for _, key := range strings.Split(v, "\n") {
+			sockets.inherited[key] = os.NewFile(uintptr(fd), key)
+			fd++
+		}
+	}
+	return os.NewFile(uintptr(fd), "ready")
+}
+
+// reportReady reports on the pipe ready, if not nil, that the new
+// process is ready to serve, the upgraded one then stops. The inherited
+// sockets which are no longer used are closed.
+func reportReady(ready *os.File) {
+	if ready == nil {
+		return
+	}
+	sockets.mu.Lock()
+	for key, f := range sockets.inherited {
+		f.Close()
+		delete(sockets.inherited, key)
+	}
+	sockets.mu.Unlock()
+	ready.Write([]byte{1})
+	ready.Close()
+}
+
+// upgradeOnSignal returns a channel receiving the signal of signals
+// stopping the process: SIGTERM, SIGINT or SIGUSR2 once the process
+// replacing the current one, started on it, is ready to serve.
+func (s *server) upgradeOnSignal(signals <-chan os.Signal) <-chan os.Signal {
+	stop := make(chan os.Signal, 1)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGUSR2 {
+				slog.Info("upgrading")
+				if err := s.upgrade(); err != nil {
+					slog.Error("failed to upgrade", "err", err)
+					continue
+				}
+			}
+			stop <- sig
+			return
+		}
+	}()
+	return stop
+}
+
+// upgrade starts the process replacing the current one, which must stop
+// if it succeeds, and makes it the main one of the service for systemd.
+// The database of the statistics, which can't be opened by both, is
+// closed meanwhile and opened again if it fails.
+func (s *server) upgrade() error {
+	if overrides.inetd {
+		return errors.New("the connection served with -inetd can't be passed")
+	}
+	notifyReloading()
+	if err := s.stats.Close(); err != nil {
+		slog.Error("failed to write the statistics", "err", err)
+	}
+	pid, err := startNewProcess()
+	if err != nil {
+		if err := s.stats.Reopen(); err != nil {
+			slog.Error("failed to open the statistics", "err", err)
+		}
+		notify("READY=1")
+		return err
+	}
+	notify("MAINPID=" + strconv.Itoa(pid) + "\nREADY=1")
+	return nil
+}
+
+// startNewProcess starts a new process running the executable of the
+// current one, which may have been replaced, with the same arguments,
+// passing it the sockets. It returns once the new process is ready to
+// serve, with its PID.
+func startNewProcess() (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	sockets.mu.Lock()
+	defer sockets.mu.Unlock()
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for i, s := range sockets.sockets {
+		f, err := s.File()
+		if err != nil {
+			return 0, fmt.Errorf("socket %s can't be passed: %s", sockets.keys[i], err)
+		}
+		files = append(files, f)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(os.Environ(), upgradeEnv+"="+strings.Join(sockets.keys, "\n"))
+	err = cmd.Start()
+	w.Close()
+	// The duplicates of the file descriptors have been made blocking to
+	// be passed, the sockets sharing their mode with them
+	for _, s := range sockets.sockets {
+		if c, err := s.SyscallConn(); err == nil {
+			c.Control(func(fd uintptr) {
+				syscall.SetNonblock(int(fd), true)
+			})
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	go cmd.Wait()
+	r.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		return 0, errors.New("the new process failed to start")
+	}
+	// The Unix domain sockets are now the ones of the new process
+	for _, s := range sockets.sockets {
+		if l, ok := s.(*net.UnixListener); ok {
+			l.SetUnlinkOnClose(false)
+		}
+	}
+	return cmd.Process.Pid, nil
+}
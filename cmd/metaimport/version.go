@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// buildDate is the date of the build. It can be set at build time
+// with -ldflags "-X main.buildDate=...", the date of the VCS revision
+// is used otherwise.
+var buildDate string
+
+type versionInfo struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+func getVersion() versionInfo {
+	v := versionInfo{
+		Version:   "(devel)",
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+	if info.Main.Version != "" {
+		v.Version = info.Main.Version
+	}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			v.Revision = s.Value
+		case "vcs.modified":
+			v.Modified = s.Value == "true"
+		case "vcs.time":
+			if v.BuildDate == "" {
+				v.BuildDate = s.Value
+			}
+		}
+	}
+	return v
+}
+
+func (v versionInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "metaimport %s", v.Version)
+	if v.Revision != "" {
+		fmt.Fprintf(&b, " (%s", v.Revision)
+		if v.Modified {
+			b.WriteString(", modified")
+		}
+		b.WriteString(")")
+	}
+	if v.BuildDate != "" {
+		fmt.Fprintf(&b, " built %s", v.BuildDate)
+	}
+	fmt.Fprintf(&b, " with %s", v.GoVersion)
+	return b.String()
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(getVersion())
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func versionCommand(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	fmt.Println(getVersion())
+}
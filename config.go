@@ -0,0 +1,833 @@
+package metaimport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/hashicorp/hcl"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of metaimport. The settings used to
+// listen and to reload the configuration are ignored by Handler and
+// only used by the metaimport command.
+type Config struct {
+	Host              string            `doc:"Address to listen on, all the addresses when empty"`
+	Port              uint16            `doc:"Port to listen on, a free one being chosen when it is 0, overridden by the PORT environment variable, e.g. on Cloud Run"`
+	Listen            Addresses         `doc:"Addresses to listen on, a single one or a list, overriding host and port, e.g. 192.0.2.1:443 and [2001:db8::1]:443, or unix:/run/metaimport.sock to listen on a Unix domain socket, ignored when the sockets are passed by systemd (socket activation)"`
+	SocketMode        string            `json:"socket_mode" doc:"Permissions, in octal, of the Unix domain socket listened on, e.g. 0660 to let the group of the server connect" default:"0666"`
+	User              string            `doc:"User, by name or ID, the server runs as once it listens, e.g. to listen on port 443 when started as root, read when it starts, the certificates, templates and configuration reloaded and the files written then having to be accessible to it"`
+	Group             string            `doc:"Group, by name or ID, the server runs as once it listens, the primary group of user when empty"`
+	ShutdownTimeout   Duration          `json:"shutdown_timeout" doc:"Time given to the requests in progress to complete when the server is stopped by SIGTERM or SIGINT, read when it starts" default:"30s"`
+	ReadTimeout       Duration          `json:"read_timeout" doc:"Maximum time to read a request, body included, none when missing, read when the server starts"`
+	ReadHeaderTimeout Duration          `json:"read_header_timeout" doc:"Maximum time to read the headers of a request, protecting against the clients sending them slowly (slowloris), read when the server starts" default:"10s"`
+	WriteTimeout      Duration          `json:"write_timeout" doc:"Maximum time from the end of the headers of a request to the end of the response, none when missing, read when the server starts"`
+	IdleTimeout       Duration          `json:"idle_timeout" doc:"Maximum time to wait for the next request on a kept-alive connection, read when the server starts" default:"2m"`
+	MaxHeaderBytes    int               `json:"max_header_bytes" doc:"Maximum size in bytes of the headers of a request, request line included, read when the server starts" default:"1048576" schema:"minimum=0"`
+	MaxConns          int               `json:"max_conns" doc:"Maximum number of connections served at once, the next ones waiting to be accepted until one is closed, not limited when missing, read when the server starts" schema:"minimum=0"`
+	MaxConnsPerIP     int               `json:"max_conns_per_ip" doc:"Maximum number of connections served at once from the same IP address, the peer one and not the one given by the PROXY protocol, the next ones being closed, not limited when missing, read when the server starts" schema:"minimum=0"`
+	Tls               *TLSConfig        `doc:"TLS settings, plain HTTP is used when missing"`
+	H2C               bool              `json:"h2c" doc:"Accept HTTP/2 over the plain HTTP connections (h2c), e.g. from a service mesh sidecar terminating TLS, ignored when tls is set"`
+	ProxyProtocol     bool              `json:"proxy_protocol" doc:"Expect the connections to start with a PROXY protocol header, version 1 or 2, giving the address of the client, e.g. behind a TCP load balancer, only read from the trusted proxies if they are set"`
+	AccessLog         string            `json:"access_log" doc:"Format of the access log records written to the standard output: json, combined for the Apache combined log format or none to disable them, defaults to json"`
+	Log               *LogConfig        `doc:"Settings of the logs of the server, read when it starts"`
+	Pprof             *PprofConfig      `doc:"Serve the profiles of net/http/pprof on a separate listener, read when the server starts, disabled when missing"`
+	Watch             bool              `doc:"Reload the configuration automatically when it changes"`
+	WatchInterval     Duration          `json:"watch_interval" doc:"Interval between two fetches of a remote configuration" default:"1m"`
+	Kubernetes        *Kubernetes       `doc:"Add the import paths defined as ImportPath objects in the Kubernetes cluster"`
+	Redirect          string            `doc:"Where the browsers are sent: landing to show the landing page pkg.go.dev to redirect them to the documentation or repo to redirect them to the repository, defaults to landing"`
+	Template          string            `doc:"File holding the template of the page served to the go command, the built-in one is used when empty"`
+	LandingTemplate   string            `json:"landing_template" doc:"File holding the template of the landing page shown to the browsers, the built-in one is used when empty"`
+	IndexTemplate     string            `json:"index_template" doc:"File holding the template of the index page listing the import paths, the built-in one is used when empty"`
+	NotFoundTemplate  string            `json:"not_found_template" doc:"File holding the template of the page served for the unknown packages, the built-in one is used when empty"`
+	Favicon           string            `doc:"File served as /favicon.ico"`
+	Static            string            `doc:"Directory holding the static assets served under /-/static/, e.g. for the templates of the pages"`
+	WellKnown         map[string]string `json:"well_known" doc:"Content of the files served under /.well-known/ by name, e.g. security.txt"`
+	Robots            string            `doc:"Content of robots.txt, which defaults to disallowing everything except the index and the landing pages"`
+	CacheControl      string            `json:"cache_control" doc:"Value of the Cache-Control header of the pages, e.g. public, max-age=3600, none is sent when empty, the pages depending on an acl or auth of the import paths being private"`
+	Stats             *StatsConfig      `doc:"Settings of the statistics of the resolutions, read when the server starts, which are only kept in memory when missing"`
+	Tracing           *TracingConfig    `doc:"Export of the traces of the requests to an OpenTelemetry collector, read when the server starts, disabled when missing"`
+	Proxy             *ProxyConfig      `doc:"Built-in module proxy serving the modules of the import paths from their git repository, disabled when missing"`
+	CORS              *CORSConfig       `json:"cors" doc:"CORS settings of the JSON endpoints, the cross-origin requests are not allowed when missing"`
+	Headers           *Headers          `doc:"Security headers added to all the responses, none when missing"`
+	RateLimit         *RateLimitConfig  `json:"rate_limit" doc:"Rate limiting of the requests, reset when the configuration is reloaded, not limited when missing"`
+	ACL               *ACL              `json:"acl" doc:"Addresses of the clients allowed to use the server, the health probes and the scrapers of the metrics included, all of them when missing"`
+	TrustedProxies    []string          `json:"trusted_proxies" doc:"Networks, in CIDR notation, of the reverse proxies trusted to give the address of the clients in the Forwarded or X-Forwarded-For header or in the PROXY protocol header, unix standing for the ones connecting to the Unix domain socket listened on"`
+	ReadmeTTL         Duration          `json:"readme_ttl" doc:"Time during which the README and the description fetched from a forge are cached" default:"1h"`
+	LatestTTL         Duration          `json:"latest_ttl" doc:"Time during which the latest version tagged in a repository, served under /-/latest/ and returned by the latest template function, is cached" default:"5m"`
+	Paths             []ImportPath      `doc:"Import paths served"`
+	tmpl              *template.Template
+	trustedNets       []*net.IPNet
+	trustUnix         bool
+	etag              string
+	k8sVersion        string
+}
+
+// TLSConfig holds the TLS settings.
+type TLSConfig struct {
+	Cert         string      `doc:"Certificate file, required unless acme or certs is set, reloaded with the private key when they are modified"`
+	PrivKey      string      `json:"priv_key" doc:"Private key file, required unless acme or certs is set"`
+	Certs        []CertPair  `doc:"More certificates, the one sent being selected by the server name requested by the client (SNI), e.g. to serve several domains, cert or else the first one being sent when none matches, reloaded as cert"`
+	ACME         *ACMEConfig `json:"acme" doc:"Obtain and renew the certificates from an ACME authority such as Let's Encrypt, in place of cert and priv_key"`
+	HTTP3        bool        `json:"http3" doc:"Serve HTTP/3 over QUIC as well, on the same port in UDP, the clients being told with the Alt-Svc header, without the PROXY protocol"`
+	RedirectAddr string      `json:"redirect_addr" doc:"Address, e.g. :80, on which the HTTP requests are redirected to HTTPS, the HTTP-01 challenges being answered on it as well when acme is set, in place of http_addr"`
+	ClientCA     string      `json:"client_ca" doc:"File holding the certificates, PEM encoded, of the authorities the client certificates are verified against, read when the server starts"`
+	ClientAuth   string      `json:"client_auth" doc:"Whether the clients must send a certificate: require to reject the connections without a valid one or request to only verify the ones sent, the import paths requiring one with client_cert, defaults to request when client_ca is set"`
+	MinVersion   string      `json:"min_version" doc:"Minimum version of TLS accepted: 1.0, 1.1, 1.2 or 1.3" default:"1.2"`
+	CipherSuites []string    `json:"cipher_suites" doc:"Cipher suites enabled for TLS 1.0 to 1.2, named as by the crypto/tls Go package, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, the ones of TLS 1.3 are not configurable, defaults to the secure ones"`
+	Curves       []string    `doc:"Elliptic curves enabled for the key exchanges: X25519, P-256, P-384 or P-521"`
+}
+
+// CertPair holds the files of a certificate.
+type CertPair struct {
+	Cert    string `doc:"Certificate file" schema:"required"`
+	PrivKey string `json:"priv_key" doc:"Private key file" schema:"required"`
+}
+
+// ACMEConfig holds the settings of the certificates obtained from an
+// ACME authority.
+type ACMEConfig struct {
+	Hosts        []string            `doc:"Hosts certificates are obtained for, defaults to the hosts of the import paths"`
+	Email        string              `doc:"Contact address of the account, to be notified of the problems with the certificates"`
+	Cache        string              `doc:"Directory the account key and the certificates are stored in" schema:"required"`
+	DirectoryURL string              `json:"directory_url" doc:"Directory URL of the ACME authority, e.g. the one of the staging environment for the tests" default:"https://acme-v02.api.letsencrypt.org/directory"`
+	HTTPAddr     string              `json:"http_addr" doc:"Address, e.g. :80, on which the HTTP-01 challenges are answered and the other requests redirected to HTTPS, only TLS-ALPN-01 challenges are answered when empty"`
+	DNS          *DNSChallengeConfig `json:"dns" doc:"Answer DNS-01 challenges in place of the HTTP-01 and TLS-ALPN-01 ones, e.g. for wildcard hosts such as *.example.com or servers not reachable from the internet, hosts must then be set"`
+}
+
+// DNSChallengeConfig holds the settings of the DNS-01 challenges.
+type DNSChallengeConfig struct {
+	Provider         string   `doc:"How the TXT records of the challenges are created: rfc2136 to send dynamic updates to the name server or exec to run command" schema:"required"`
+	Nameserver       string   `doc:"Address, host:port, of the name server the updates are sent to when provider is rfc2136"`
+	Zone             string   `doc:"Zone holding the records of the challenges when provider is rfc2136, e.g. example.com"`
+	TSIGKey          string   `json:"tsig_key" doc:"Name of the TSIG key the updates are signed with, they are not signed when empty"`
+	TSIGSecret       string   `json:"tsig_secret" doc:"Secret of the TSIG key, base64 encoded"`
+	TSIGAlgorithm    string   `json:"tsig_algorithm" doc:"Algorithm of the TSIG key: hmac-sha1, hmac-sha256 or hmac-sha512" default:"hmac-sha256"`
+	Command          []string `doc:"Command run when provider is exec, with the arguments present or cleanup, the name of the record, e.g. _acme-challenge.example.com., and its value"`
+	PropagationDelay Duration `json:"propagation_delay" doc:"Time waited after the creation of the records for them to be visible to the authority" default:"30s"`
+}
+
+// Headers holds the security headers added to the responses, the
+// empty ones are not sent.
+type Headers struct {
+	HSTS               string `json:"hsts" doc:"Value of the Strict-Transport-Security header, e.g. max-age=63072000; includeSubDomains"`
+	ContentTypeOptions string `json:"content_type_options" doc:"Value of the X-Content-Type-Options header, e.g. nosniff"`
+	ReferrerPolicy     string `json:"referrer_policy" doc:"Value of the Referrer-Policy header, e.g. strict-origin-when-cross-origin"`
+	CSP                string `json:"csp" doc:"Value of the Content-Security-Policy header, e.g. default-src 'self'"`
+}
+
+// set adds the headers of hdrs to the header h.
+func (hdrs *Headers) set(h http.Header) {
+	for name, value := range map[string]string{
+		"Strict-Transport-Security": hdrs.HSTS,
+		"X-Content-Type-Options":    hdrs.ContentTypeOptions,
+		"Referrer-Policy":           hdrs.ReferrerPolicy,
+		"Content-Security-Policy":   hdrs.CSP,
+	} {
+		if value != "" {
+			h.Set(name, value)
+		}
+	}
+}
+
+// CORSConfig holds the CORS settings of the JSON endpoints.
+type CORSConfig struct {
+	Origins []string `doc:"Origins allowed to query the JSON endpoints, * allows any origin" schema:"required"`
+	Methods []string `doc:"Methods allowed, defaults to GET and HEAD"`
+}
+
+// handle adds the CORS headers to the response to r if its origin is
+// allowed and reports whether r was a preflight request, in which case
+// it has been answered.
+func (c *CORSConfig) handle(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	w.Header().Add("Vary", "Origin")
+	allowed := false
+	for _, o := range c.Origins {
+		if o == "*" || o == origin {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	methods := c.Methods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead}
+	}
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// PprofConfig holds the settings of the listener serving the profiles.
+type PprofConfig struct {
+	Addr  string `doc:"Address the profiles are served on, under /debug/pprof/" default:"localhost:6060"`
+	Token string `doc:"Token expected as bearer token or as the token parameter, required unless the address is a loopback one"`
+}
+
+// LogConfig holds the settings of the logs.
+type LogConfig struct {
+	Level      string        `doc:"Minimum level of the messages logged: debug, info, warn or error" default:"info"`
+	Format     string        `doc:"Format of the messages: text or json" default:"text"`
+	File       string        `doc:"File the messages are appended to, in place of the standard error"`
+	MaxSize    int           `json:"max_size" doc:"Size in megabytes from which the file is rotated, never rotated on size when zero" schema:"minimum=0"`
+	MaxAge     Duration      `json:"max_age" doc:"Age from which the file is rotated, e.g. 24h, never rotated on age when zero"`
+	MaxBackups int           `json:"max_backups" doc:"Number of rotated files kept, all of them when zero" schema:"minimum=0"`
+	Compress   bool          `doc:"Compress the rotated files with gzip"`
+	Syslog     *SyslogConfig `doc:"Send the messages to a syslog daemon, in place of the standard error or the file"`
+}
+
+// SyslogConfig holds the settings of the syslog daemon the logs are
+// sent to.
+type SyslogConfig struct {
+	Network  string `doc:"Network the daemon is reached on: udp, tcp or unix" default:"unix"`
+	Addr     string `doc:"Address of the daemon, host:port or the path of its socket" default:"/dev/log"`
+	Facility string `doc:"Facility of the messages, e.g. daemon or local0" default:"daemon"`
+	Tag      string `doc:"Tag identifying the program in the messages" default:"metaimport"`
+}
+
+// syslogFacilities holds the syslog facilities, the index of a facility
+// being its code.
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// FacilityCode returns the code of the facility of the messages, -1 if
+// it's unknown.
+func (c *SyslogConfig) FacilityCode() int {
+	if c.Facility == "" {
+		return 3 // daemon
+	}
+	for code, name := range syslogFacilities {
+		if c.Facility == name {
+			return code
+		}
+	}
+	return -1
+}
+
+// ImportPath describes the packages matched by a prefix and the
+// repository they are served from.
+type ImportPath struct {
+	Prefix         string           `doc:"Prefix of the packages matched by this import path, required unless regexp is set"`
+	Regexp         string           `json:"regexp" doc:"Regular expression matching the import prefix of the packages, e.g. go\\.example\\.com/([a-z]+)-([a-z]+), nb_components being then ignored and prefix, which the packages must also start with, defaulting to its literal prefix. The templates are executed with the submatches, the import prefix followed by the capture groups, rather than the components of the package name"`
+	NbComponents   int              `json:"nb_components" doc:"Number of components of the package name making the import prefix, defaults to the number of components of the prefix" schema:"minimum=0"`
+	VCS            string           `doc:"Version control system of the repository" schema:"required"`
+	RepoTemplate   string           `json:"repo_template" doc:"Template of the repository URL, executed with the components of the package name, or the submatches of regexp" schema:"required"`
+	Source         *SourceTemplates `doc:"Templates of the go-source meta tag, which is not emitted when missing"`
+	Forge          string           `doc:"Forge hosting the repository, used to build the go-source meta tag from the repository URL when source is missing: github, gitlab, gitea, bitbucket or sourcehut"`
+	Branch         string           `doc:"Branch linked to by the go-source meta tag built for the forge, defaults to main for gitea and to HEAD otherwise"`
+	Redirect       string           `doc:"Where the browsers are sent for the packages of this import path, overrides the global redirect setting"`
+	Description    string           `doc:"Description of the packages shown on the landing page and in the OpenGraph meta tags, fetched from the API of the forge when empty and forge is github, gitlab or gitea"`
+	Readme         bool             `doc:"Show the README of the repository on the landing page, rendered by the API of the forge, which must be github, gitlab or gitea, unless the import path is matched by a regexp"`
+	BrowseTemplate string           `json:"browse_template" doc:"Template of the URL the browsers are redirected to when redirect is repo, defaults to the repository URL"`
+	Mode           string           `doc:"How the go command fetches the packages: vcs to clone the repository or mod to download them from the module proxy given by proxy_template, defaults to vcs"`
+	ProxyTemplate  string           `json:"proxy_template" doc:"Template of the base URL of the module proxy serving the packages when mode is mod, executed as the repo template"`
+	VCSNetworks    []string         `json:"vcs_networks" doc:"Networks, in CIDR notation, of the clients told to clone the repository even though mode is mod, e.g. the internal ones"`
+	ACL            *ACL             `json:"acl" doc:"Addresses of the clients the packages are disclosed to, the others getting the same answer as for an unknown package, all of them when missing"`
+	Auth           *Auth            `doc:"Credentials required to resolve the packages, asked with a 401 error, none when missing"`
+	vcsNets        []*net.IPNet
+	re             *regexp.Regexp
+}
+
+// vcsClient reports whether the client whose address is ip is told to
+// clone the repository when the import path is in mod mode.
+func (p *ImportPath) vcsClient(ip net.IP) bool {
+	return containsIP(p.vcsNets, ip)
+}
+
+// ACL restricts the clients allowed by their address.
+type ACL struct {
+	Allow []string `doc:"Networks, in CIDR notation, of the clients allowed, all of them when empty"`
+	Deny  []string `doc:"Networks, in CIDR notation, of the clients denied, even if they are in an allowed network"`
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// compile parses the networks of a.
+func (a *ACL) compile() error {
+	var err error
+	if a.allow, err = parseNetworks(a.Allow); err != nil {
+		return err
+	}
+	a.deny, err = parseNetworks(a.Deny)
+	return err
+}
+
+// allowed reports whether the client whose address is ip is allowed by
+// a, all of them being allowed if a is nil. A client whose address is
+// unknown is only allowed if there are no networks to check.
+func (a *ACL) allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if ip == nil {
+		return len(a.allow) == 0 && len(a.deny) == 0
+	}
+	if containsIP(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || containsIP(a.allow, ip)
+}
+
+// parseNetworks parses the networks in CIDR notation cidrs.
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// containsIP reports whether ip is in one of the networks nets.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SourceTemplates holds the templates of the URLs of the go-source
+// meta tag. They are executed with the components of the package name,
+// as the repo template. The directory and file templates may contain
+// the {dir}, {/dir}, {file} and {line} placeholders replaced by the
+// tools using go-source.
+type SourceTemplates struct {
+	HomeTemplate      string `json:"home_template" doc:"Template of the URL of the home page of the repository" schema:"required"`
+	DirectoryTemplate string `json:"directory_template" doc:"Template of the URL of a directory, no link is provided when empty"`
+	FileTemplate      string `json:"file_template" doc:"Template of the URL of a file, no link is provided when empty"`
+}
+
+// templates returns the home, directory and file templates.
+func (s *SourceTemplates) templates() []string {
+	return []string{s.HomeTemplate, s.DirectoryTemplate, s.FileTemplate}
+}
+
+// Duration is a time.Duration written as a string such as "1m30s" in
+// the configuration.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Addresses is a list of addresses, which may be written as a single
+// string in the configuration.
+type Addresses []string
+
+func (a *Addresses) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = Addresses{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// configFormat returns the format of the configuration file based on
+// its extension. JSON is assumed when the extension is unknown.
+func configFormat(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	case ".hcl":
+		return "hcl"
+	default:
+		return "json"
+	}
+}
+
+// toJSON converts a configuration written in another format to JSON
+// so that it can be decoded using the same rules as a JSON
+// configuration file.
+func toJSON(r io.Reader, format string) (io.Reader, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("conf: %s", err)
+	}
+	var v interface{}
+	switch format {
+	case "yaml":
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("conf: %s", err)
+		}
+	case "toml":
+		if err := toml.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("conf: %s", err)
+		}
+	case "hcl":
+		if err := hcl.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("conf: %s", err)
+		}
+		v = unwrapBlocks(v, reflect.TypeOf(Config{}))
+	}
+	data, err = json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("conf: %s", err)
+	}
+	return bytes.NewReader(data), nil
+}
+
+// ParseConfig parses the configuration read from r, written in the
+// given format: json, yaml, toml or hcl. The references to environment
+// variables written as ${VAR} are expanded, ${VAR:-default} giving the
+// value used when VAR is unset or empty. $${ is written as a literal ${.
+func ParseConfig(r io.Reader, format string) (*Config, error) {
+	return parseConfig(r, format, true)
+}
+
+// parseConfig implements ParseConfig, the environment variables being
+// only expanded if expand is true. They are not for the configurations
+// written by others than the operator, e.g. the ImportPath objects of
+// Kubernetes or the KV stores, which must not disclose the secrets of
+// the environment.
+func parseConfig(r io.Reader, format string, expand bool) (*Config, error) {
+	if format != "json" {
+		var err error
+		if r, err = toJSON(r, format); err != nil {
+			return nil, err
+		}
+	}
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	var conf Config
+	if err := decoder.Decode(&conf); err != nil {
+		switch err.(type) {
+		case *json.SyntaxError:
+			err := err.(*json.SyntaxError)
+			return nil, fmt.Errorf("conf: syntax error at pos %d: %s", err.Offset, err)
+		case *json.UnmarshalTypeError:
+			err := err.(*json.UnmarshalTypeError)
+			return nil, fmt.Errorf("conf: bad configuration file: %s", err)
+		default:
+			return nil, fmt.Errorf("conf: %s", err)
+		}
+	}
+	if expand {
+		if err := expandEnv(reflect.ValueOf(&conf)); err != nil {
+			return nil, err
+		}
+	}
+	return &conf, nil
+}
+
+// envVarRegexp matches the escaped $${ and the references to
+// environment variables, along with their default value.
+var envVarRegexp = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// expandEnv replaces ${VAR} in all the strings held by v with the
+// value of the environment variable VAR and $${ with ${. Undefined
+// variables without a default value are reported as errors rather than
+// being replaced by an empty string.
+func expandEnv(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			return expandEnv(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				if err := expandEnv(v.Field(i)); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := expandEnv(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			e := reflect.New(v.Type().Elem()).Elem()
+			e.Set(v.MapIndex(k))
+			if err := expandEnv(e); err != nil {
+				return err
+			}
+			v.SetMapIndex(k, e)
+		}
+	case reflect.String:
+		var err error
+		s := envVarRegexp.ReplaceAllStringFunc(v.String(), func(m string) string {
+			if m == "$${" {
+				return "${"
+			}
+			sub := envVarRegexp.FindStringSubmatch(m)
+			name := sub[1]
+			val, ok := os.LookupEnv(name)
+			if sub[2] != "" {
+				if val == "" {
+					val = sub[2][len(":-"):]
+				}
+				return val
+			}
+			if !ok && err == nil {
+				err = fmt.Errorf("conf: environment variable %s is not set", name)
+			}
+			return val
+		})
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+	}
+	return nil
+}
+
+// parseImportPath parses a single import path by wrapping it into a
+// configuration so that it's decoded with the same rules, without
+// expanding the environment variables.
+func parseImportPath(value []byte, format string) (*Config, error) {
+	r := io.Reader(bytes.NewReader(value))
+	if format != "json" {
+		var err error
+		if r, err = toJSON(r, format); err != nil {
+			return nil, err
+		}
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := append(append([]byte(`{"paths":[`), data...), "]}"...)
+	return parseConfig(bytes.NewReader(wrapped), "json", false)
+}
+
+// LoadConfig reads, parses and compiles the configuration file name.
+// If name is a directory, the configuration files it contains are
+// merged in lexical order. If name is an HTTP(S), S3 or GCS URL, the
+// configuration is fetched from it. If name refers to an etcd or
+// Consul KV store, the configuration is read from the keys it holds.
+func LoadConfig(name string) (*Config, error) {
+	conf, err := readConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := conf.prepare(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func readConfig(name string) (*Config, error) {
+	if isKVURL(name) {
+		return fetchKVConfig(name)
+	}
+	if isURL(name) {
+		return fetchConfig(name, "")
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return readConfigDir(name)
+	}
+	return readConfigFile(name)
+}
+
+func readConfigFile(name string) (*Config, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	conf, err := ParseConfig(f, configFormat(name))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return conf, nil
+}
+
+// isConfigFile reports whether name looks like a configuration file
+// that should be read when merging a configuration directory. Hidden
+// files are ignored.
+func isConfigFile(name string) bool {
+	base := filepath.Base(name)
+	if strings.HasPrefix(base, ".") {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(base)) {
+	case ".json", ".yaml", ".yml", ".toml", ".hcl":
+		return true
+	}
+	return false
+}
+
+func readConfigDir(dir string) (*Config, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	conf := &Config{}
+	for _, e := range entries {
+		name := filepath.Join(dir, e.Name())
+		if !isConfigFile(name) {
+			continue
+		}
+		// Follow symlinks, configuration directories mounted from
+		// a Kubernetes ConfigMap are made of them
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		c, err := readConfigFile(name)
+		if err != nil {
+			return nil, err
+		}
+		mergeConfig(conf, c)
+	}
+	return conf, nil
+}
+
+// mergeConfig merges src into dst. Lists from src are appended to the
+// ones of dst and the other settings of src override the ones of dst
+// when they are set.
+func mergeConfig(dst, src *Config) {
+	d := reflect.ValueOf(dst).Elem()
+	s := reflect.ValueOf(src).Elem()
+	for i := 0; i < d.NumField(); i++ {
+		df, sf := d.Field(i), s.Field(i)
+		if !df.CanSet() || sf.IsZero() {
+			continue
+		}
+		if df.Kind() == reflect.Slice {
+			df.Set(reflect.AppendSlice(df, sf))
+		} else {
+			df.Set(sf)
+		}
+	}
+}
+
+// prepare completes the configuration with the import paths defined
+// in the Kubernetes cluster, if any, and compiles it.
+func (conf *Config) prepare() error {
+	if conf.Kubernetes != nil {
+		if err := conf.Kubernetes.addPaths(conf); err != nil {
+			return err
+		}
+	}
+	return conf.compile()
+}
+
+// compile fills in the default values of the configuration and
+// compiles the templates of the pages, read from the files given by
+// the configuration if any, and the ones of each import path.
+func (conf *Config) compile() error {
+	tmpl, err := mainTemplate.Clone()
+	if err != nil {
+		return err
+	}
+	tmpl.Funcs(template.FuncMap{
+		"latest": func(repo string) string {
+			return latest(context.Background(), repo, conf.latestTTL())
+		},
+	})
+	for name, file := range map[string]string{
+		mainTemplate.Name():     conf.Template,
+		landingTemplate.Name():  conf.LandingTemplate,
+		indexTemplate.Name():    conf.IndexTemplate,
+		notFoundTemplate.Name(): conf.NotFoundTemplate,
+	} {
+		if file == "" {
+			continue
+		}
+		text, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("conf: %s", err)
+		}
+		if _, err := tmpl.Lookup(name).Parse(string(text)); err != nil {
+			return fmt.Errorf("conf: bad template %q: %s", file, err)
+		}
+	}
+	var cidrs []string
+	conf.trustUnix = false
+	for _, p := range conf.TrustedProxies {
+		if p == "unix" {
+			conf.trustUnix = true
+		} else {
+			cidrs = append(cidrs, p)
+		}
+	}
+	if conf.trustedNets, err = parseNetworks(cidrs); err != nil {
+		return fmt.Errorf("conf: bad trusted proxy network: %s", err)
+	}
+	if conf.ACL != nil {
+		if err := conf.ACL.compile(); err != nil {
+			return fmt.Errorf("conf: bad acl network: %s", err)
+		}
+	}
+	for i := range conf.Paths {
+		p := &conf.Paths[i]
+		if p.Regexp != "" {
+			re, err := regexp.Compile(p.Regexp)
+			if err != nil {
+				return fmt.Errorf("conf: bad regexp %q: %s", p.Regexp, err)
+			}
+			if p.Prefix == "" {
+				p.Prefix, _ = re.LiteralPrefix()
+			}
+			// The whole import prefix, ending with a component, is
+			// matched
+			p.re = regexp.MustCompile(`^(?:` + p.Regexp + `)(?:/|$)`)
+		}
+		if p.NbComponents <= 0 {
+			p.NbComponents = len(strings.Split(p.Prefix, "/"))
+		}
+		if p.vcsNets, err = parseNetworks(p.VCSNetworks); err != nil {
+			return fmt.Errorf("conf: bad vcs network for %q: %s", p.Prefix, err)
+		}
+		if p.ACL != nil {
+			if err := p.ACL.compile(); err != nil {
+				return fmt.Errorf("conf: bad acl network for %q: %s", p.Prefix, err)
+			}
+		}
+		if p.Auth != nil {
+			if err := p.Auth.load(); err != nil {
+				return fmt.Errorf("conf: bad auth for %q: %s", p.Prefix, err)
+			}
+		}
+		name := templateNameForImportPath(i)
+		if _, err := tmpl.New(name).Parse(p.RepoTemplate); err != nil {
+			return fmt.Errorf("conf: bad repo template for %q: %s", p.Prefix, err)
+		}
+		if p.BrowseTemplate != "" {
+			if _, err := tmpl.New(browseTemplateName(name)).Parse(p.BrowseTemplate); err != nil {
+				return fmt.Errorf("conf: bad browse template for %q: %s", p.Prefix, err)
+			}
+		}
+		if p.ProxyTemplate != "" {
+			if _, err := tmpl.New(proxyTemplateName(name)).Parse(p.ProxyTemplate); err != nil {
+				return fmt.Errorf("conf: bad proxy template for %q: %s", p.Prefix, err)
+			}
+		}
+		if p.Source == nil {
+			continue
+		}
+		for j, text := range p.Source.templates() {
+			if text == "" {
+				// The go-source meta tag uses _ for a missing URL
+				text = "_"
+			}
+			if _, err := tmpl.New(sourceTemplateName(name, j)).Parse(text); err != nil {
+				return fmt.Errorf("conf: bad source template for %q: %s", p.Prefix, err)
+			}
+		}
+	}
+	conf.tmpl = tmpl
+	return nil
+}
+
+// unwrapBlocks walks a decoded HCL configuration alongside the Go type
+// it will be decoded into. HCL decodes every block as a list of
+// objects, even when the block is only allowed once, so lists holding
+// a single object are unwrapped when the target is not a slice.
+func unwrapBlocks(v interface{}, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch v := v.(type) {
+	case []interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for i := range v {
+				v[i] = unwrapBlocks(v[i], t.Elem())
+			}
+			return v
+		}
+		if len(v) == 1 {
+			return unwrapBlocks(v[0], t)
+		}
+	case []map[string]interface{}:
+		l := make([]interface{}, len(v))
+		for i := range v {
+			l[i] = v[i]
+		}
+		return unwrapBlocks(l, t)
+	case map[string]interface{}:
+		for k, e := range v {
+			switch t.Kind() {
+			case reflect.Map:
+				v[k] = unwrapBlocks(e, t.Elem())
+			case reflect.Struct:
+				if f, ok := jsonField(t, k); ok {
+					v[k] = unwrapBlocks(e, f.Type)
+				}
+			}
+		}
+	}
+	return v
+}
+
+// jsonField returns the field of the struct type t that the JSON
+// decoder would use for the given key.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = f.Name
+		}
+		if strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
@@ -0,0 +1,211 @@
+package metaimport
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"10-base.yaml": `
+host: 127.0.0.1
+port: 8080
+redirect: landing
+trusted_proxies: [10.0.0.0/8]
+paths:
+  - prefix: example.com/a
+    vcs: git
+    repo_template: https://git.example.com/a.git
+`,
+		"20-paths.json": `{
+  "paths": [
+    {"prefix": "example.com/b", "vcs": "git", "repo_template": "https://git.example.com/b.git"}
+  ]
+}`,
+		"30-override.toml": `
+port = 9090
+trusted_proxies = ["192.168.0.0/16"]
+
+[[paths]]
+prefix = "example.com/c"
+vcs = "git"
+repo_template = "https://git.example.com/c.git"
+`,
+		// Neither hidden files nor the files of other formats are read
+		".40-hidden.yaml": "port: 1\n",
+		"50-notes.txt":    "port: 2\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf, err := LoadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prefixes []string
+	for _, p := range conf.Paths {
+		prefixes = append(prefixes, p.Prefix)
+	}
+	if want := []string{"example.com/a", "example.com/b", "example.com/c"}; !reflect.DeepEqual(prefixes, want) {
+		t.Errorf("prefixes = %q, want %q", prefixes, want)
+	}
+	if want := []string{"10.0.0.0/8", "192.168.0.0/16"}; !reflect.DeepEqual(conf.TrustedProxies, want) {
+		t.Errorf("trusted proxies = %q, want %q", conf.TrustedProxies, want)
+	}
+	// The last file setting a value wins, the unset ones leave it as is
+	if conf.Port != 9090 {
+		t.Errorf("port = %d, want 9090", conf.Port)
+	}
+	if conf.Host != "127.0.0.1" || conf.Redirect != "landing" {
+		t.Errorf("host, redirect = %q, %q, want 127.0.0.1, landing", conf.Host, conf.Redirect)
+	}
+}
+
+func TestParseConfigHCL(t *testing.T) {
+	conf, err := ParseConfig(strings.NewReader(`
+port = 8080
+trusted_proxies = ["10.0.0.0/8"]
+
+tls {
+  cert = "/etc/metaimport/cert.pem"
+  priv_key = "/etc/metaimport/key.pem"
+}
+
+well_known {
+  "security.txt" = "Contact: mailto:security@example.com"
+}
+
+paths {
+  prefix = "example.com/a"
+  vcs = "git"
+  repo_template = "https://git.example.com/a.git"
+  acl {
+    allow = ["10.0.0.0/8"]
+  }
+}
+
+paths {
+  prefix = "example.com/b"
+  vcs = "git"
+  repo_template = "https://git.example.com/b.git"
+}
+`), "hcl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The blocks allowed once are unwrapped, the repeated ones are
+	// kept as lists
+	if conf.Port != 8080 || !reflect.DeepEqual(conf.TrustedProxies, []string{"10.0.0.0/8"}) {
+		t.Errorf("port, trusted proxies = %d, %q, want 8080, [10.0.0.0/8]", conf.Port, conf.TrustedProxies)
+	}
+	if conf.Tls == nil || conf.Tls.Cert != "/etc/metaimport/cert.pem" || conf.Tls.PrivKey != "/etc/metaimport/key.pem" {
+		t.Errorf("tls = %+v, want the cert and key", conf.Tls)
+	}
+	if got := conf.WellKnown["security.txt"]; got != "Contact: mailto:security@example.com" {
+		t.Errorf("well_known[security.txt] = %q", got)
+	}
+	if len(conf.Paths) != 2 || conf.Paths[0].Prefix != "example.com/a" || conf.Paths[1].Prefix != "example.com/b" {
+		t.Fatalf("paths = %+v, want example.com/a and example.com/b", conf.Paths)
+	}
+	if acl := conf.Paths[0].ACL; acl == nil || !reflect.DeepEqual(acl.Allow, []string{"10.0.0.0/8"}) {
+		t.Errorf("acl = %+v, want allow 10.0.0.0/8", acl)
+	}
+	// A single block of a repeated one is still a list
+	conf, err = ParseConfig(strings.NewReader(`
+paths {
+  prefix = "example.com/a"
+  vcs = "git"
+  repo_template = "https://git.example.com/a.git"
+}
+`), "hcl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Paths) != 1 || conf.Paths[0].Prefix != "example.com/a" {
+		t.Errorf("paths = %+v, want example.com/a", conf.Paths)
+	}
+}
+
+func TestParseConfigEnv(t *testing.T) {
+	t.Setenv("METAIMPORT_TEST_HOST", "git.example.com")
+	t.Setenv("METAIMPORT_TEST_TOKEN", "s3cr$t")
+	t.Setenv("METAIMPORT_TEST_EMPTY", "")
+	conf, err := ParseConfig(strings.NewReader(`{
+  "tracing": {
+    "endpoint": "https://otel.example.com",
+    "headers": {"Authorization": "Bearer ${METAIMPORT_TEST_TOKEN}"}
+  },
+  "paths": [
+    {
+      "prefix": "example.com/a",
+      "vcs": "git",
+      "repo_template": "https://${METAIMPORT_TEST_HOST}/a.git${METAIMPORT_TEST_EMPTY}",
+      "auth": {"users": {"alice": "$2a$04$R.i1ojUBlQO3URWZxz87Gu2Q6OGKBEw.BUQl9tnoxuoNLxoZL5ZQ6"}}
+    },
+    {
+      "prefix": "example.com/b",
+      "vcs": "git",
+      "repo_template": "https://${METAIMPORT_TEST_UNSET:-git.example.org}/b.git${METAIMPORT_TEST_EMPTY:-}",
+      "description": "run: echo $${HOME} $${METAIMPORT_TEST_HOST}"
+    }
+  ]
+}`), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"repo template", conf.Paths[0].RepoTemplate, "https://git.example.com/a.git"},
+		// The values of the variables are not expanded again
+		{"header", conf.Tracing.Headers["Authorization"], "Bearer s3cr$t"},
+		// Only the references written as ${VAR} are expanded
+		{"password", conf.Paths[0].Auth.Users["alice"], "$2a$04$R.i1ojUBlQO3URWZxz87Gu2Q6OGKBEw.BUQl9tnoxuoNLxoZL5ZQ6"},
+		// The default value is used for the unset variables
+		{"default", conf.Paths[1].RepoTemplate, "https://git.example.org/b.git"},
+		// $${ is a literal ${
+		{"escape", conf.Paths[1].Description, "run: echo ${HOME} ${METAIMPORT_TEST_HOST}"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s = %q, want %q", test.name, test.got, test.want)
+		}
+	}
+	_, err = ParseConfig(strings.NewReader(`{"host": "${METAIMPORT_TEST_UNSET}"}`), "json")
+	if err == nil || !strings.Contains(err.Error(), "METAIMPORT_TEST_UNSET is not set") {
+		t.Errorf("ParseConfig with an unset variable: %v, want an error", err)
+	}
+}
+
+func TestParseConfigNoEnv(t *testing.T) {
+	t.Setenv("METAIMPORT_TEST_SECRET", "s3cr3t")
+	const spec = `{"prefix": "example.com/a", "vcs": "git", "repo_template": "https://git.example.com/${METAIMPORT_TEST_SECRET}"}`
+	const want = "https://git.example.com/${METAIMPORT_TEST_SECRET}"
+	// The ImportPath objects of Kubernetes are parsed as the import
+	// paths of the KV stores
+	conf, err := parseImportPath([]byte(spec), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conf.Paths[0].RepoTemplate; got != want {
+		t.Errorf("import path repo template = %q, want %q", got, want)
+	}
+	conf, err = configFromKV("metaimport/", []kvPair{
+		{key: "metaimport/config.json", value: []byte(`{"host": "${METAIMPORT_TEST_SECRET}"}`)},
+		{key: "metaimport/paths/a.json", value: []byte(spec)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Host != "${METAIMPORT_TEST_SECRET}" || conf.Paths[0].RepoTemplate != want {
+		t.Errorf("KV host, repo template = %q, %q, want them as written", conf.Host, conf.Paths[0].RepoTemplate)
+	}
+}
@@ -0,0 +1,52 @@
+package metaimport
+
+import (
+	"sort"
+	"strings"
+)
+
+// forgeFormat holds the suffixes appended to the home page of a
+// repository to build the directory and file URLs of the go-source
+// meta tag. {branch} is replaced by the branch of the import path.
+type forgeFormat struct {
+	dir, file string
+	// branch is the branch used when the import path doesn't
+	// set one.
+	branch string
+}
+
+var forges = map[string]forgeFormat{
+	"github":    {"/tree/{branch}{/dir}", "/blob/{branch}{/dir}/{file}#L{line}", "HEAD"},
+	"gitlab":    {"/-/tree/{branch}{/dir}", "/-/blob/{branch}{/dir}/{file}#L{line}", "HEAD"},
+	"gitea":     {"/src/branch/{branch}{/dir}", "/src/branch/{branch}{/dir}/{file}#L{line}", "main"},
+	"bitbucket": {"/src/{branch}{/dir}", "/src/{branch}{/dir}/{file}#lines-{line}", "HEAD"},
+	"sourcehut": {"/tree/{branch}/item{/dir}", "/tree/{branch}/item{/dir}/{file}#L{line}", "HEAD"},
+}
+
+// forgeNames returns the names of the known forges.
+func forgeNames() []string {
+	names := make([]string, 0, len(forges))
+	for name := range forges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// forgeSource returns the URLs of the go-source meta tag of the
+// repository repo hosted by forge, nil if the forge is unknown.
+func forgeSource(forge, branch, repo string) *Source {
+	f, ok := forges[forge]
+	if !ok {
+		return nil
+	}
+	if branch == "" {
+		branch = f.branch
+	}
+	home := strings.TrimSuffix(strings.TrimSuffix(repo, "/"), ".git")
+	return &Source{
+		Home:      home,
+		Directory: home + strings.Replace(f.dir, "{branch}", branch, -1),
+		File:      home + strings.Replace(f.file, "{branch}", branch, -1),
+	}
+}
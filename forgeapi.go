@@ -0,0 +1,301 @@
+package metaimport
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The API of the forge hosting a repository is used to render its
+// README, the forge sanitizing the HTML it produces, and to get its
+// description.
+
+// forgeAPI holds the functions fetching the information about the
+// repository whose home page is given from the API of a forge.
+type forgeAPI struct {
+	readme      func(u *url.URL) (template.HTML, error)
+	description func(u *url.URL) (string, error)
+}
+
+var forgeAPIs = map[string]forgeAPI{
+	"github": {githubReadme, githubDescription},
+	"gitlab": {gitlabReadme, gitlabDescription},
+	"gitea":  {giteaReadme, giteaDescription},
+}
+
+// defaultReadmeTTL is the time during which the information fetched
+// from a forge is cached when readme_ttl is not set.
+const defaultReadmeTTL = time.Hour
+
+// forgeErrorTTL is the time during which a failure to fetch an
+// information from a forge is cached.
+const forgeErrorTTL = time.Minute
+
+// maxForgeEntries is the maximum number of information kept in the
+// cache of the forges.
+const maxForgeEntries = 4096
+
+var forgeClient = &http.Client{Timeout: 10 * time.Second}
+
+type forgeEntry struct {
+	value   string
+	expires time.Time
+}
+
+// forgeCache caches the information fetched from the forges by kind
+// and home page. It's shared by all the handlers so that it survives
+// configuration reloads.
+var forgeCache struct {
+	sync.Mutex
+	entries map[string]forgeEntry
+}
+
+// cachedForgeInfo returns the information kind about the repository
+// whose home page is home, fetching it with fetch if it's not in the
+// cache. An empty string is returned if it can't be fetched.
+func cachedForgeInfo(kind, home string, ttl time.Duration, fetch func(u *url.URL) (string, error)) string {
+	key := kind + " " + home
+	forgeCache.Lock()
+	e, ok := forgeCache.entries[key]
+	forgeCache.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.value
+	}
+	u, err := url.Parse(home)
+	if err == nil {
+		e.value, err = fetch(u)
+	}
+	if err != nil {
+		slog.Warn("failed to fetch from the forge", "kind", kind, "home", home, "err", err)
+		ttl = forgeErrorTTL
+	}
+	now := time.Now()
+	e.expires = now.Add(ttl)
+	forgeCache.Lock()
+	if forgeCache.entries == nil {
+		forgeCache.entries = map[string]forgeEntry{}
+	}
+	if _, ok := forgeCache.entries[key]; !ok && len(forgeCache.entries) >= maxForgeEntries {
+		evictForgeEntries(now)
+	}
+	forgeCache.entries[key] = e
+	forgeCache.Unlock()
+	return e.value
+}
+
+// evictForgeEntries makes room in the forge cache, which must be
+// locked, removing the entries expired at now or, if there are none,
+// an arbitrary one.
+func evictForgeEntries(now time.Time) {
+	for k, e := range forgeCache.entries {
+		if !now.Before(e.expires) {
+			delete(forgeCache.entries, k)
+		}
+	}
+	for k := range forgeCache.entries {
+		if len(forgeCache.entries) < maxForgeEntries {
+			break
+		}
+		delete(forgeCache.entries, k)
+	}
+}
+
+// readme returns the rendered README of the repository whose home page
+// is home, hosted by forge.
+func readme(forge, home string, ttl time.Duration) template.HTML {
+	html := cachedForgeInfo("readme", home, ttl, func(u *url.URL) (string, error) {
+		html, err := forgeAPIs[forge].readme(u)
+		return string(html), err
+	})
+	return template.HTML(html)
+}
+
+// description returns the description of the repository whose home
+// page is home, hosted by forge.
+func description(forge, home string, ttl time.Duration) string {
+	return cachedForgeInfo("description", home, ttl, forgeAPIs[forge].description)
+}
+
+// forgeJSON fetches u and decodes the JSON object it returns into v.
+func forgeJSON(u string, header http.Header, v interface{}) error {
+	data, err := forgeDo(http.MethodGet, u, header, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// forgeDo sends the request built from the given arguments and
+// returns the body of the response.
+func forgeDo(method, u string, header http.Header, body interface{}) ([]byte, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := forgeClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("%s %s: %s", method, u, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// repoPath returns the path of the repository whose home page is u.
+func repoPath(u *url.URL) string {
+	return strings.Trim(u.Path, "/")
+}
+
+// githubAPI returns the URL of the API of the repository whose home
+// page is u and the headers of the requests.
+func githubAPI(u *url.URL) (string, http.Header) {
+	api := "https://api.github.com"
+	if u.Host != "github.com" {
+		// GitHub Enterprise Server
+		api = u.Scheme + "://" + u.Host + "/api/v3"
+	}
+	header := http.Header{"Accept": {"application/vnd.github+json"}}
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return api + "/repos/" + repoPath(u), header
+}
+
+func githubReadme(u *url.URL) (template.HTML, error) {
+	api, header := githubAPI(u)
+	header.Set("Accept", "application/vnd.github.html+json")
+	html, err := forgeDo(http.MethodGet, api+"/readme", header, nil)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(html), nil
+}
+
+func githubDescription(u *url.URL) (string, error) {
+	api, header := githubAPI(u)
+	var repo struct {
+		Description string
+	}
+	err := forgeJSON(api, header, &repo)
+	return repo.Description, err
+}
+
+// gitlabAPI returns the URL of the API of the GitLab instance hosting
+// the repository whose home page is u and the headers of the requests.
+func gitlabAPI(u *url.URL) (string, http.Header) {
+	header := http.Header{}
+	if token := os.Getenv("GITLAB_TOKEN"); token != "" {
+		header.Set("PRIVATE-TOKEN", token)
+	}
+	return u.Scheme + "://" + u.Host + "/api/v4", header
+}
+
+func gitlabReadme(u *url.URL) (template.HTML, error) {
+	api, header := gitlabAPI(u)
+	project := api + "/projects/" + url.PathEscape(repoPath(u))
+	var p struct {
+		ReadmeURL string `json:"readme_url"`
+	}
+	if err := forgeJSON(project, header, &p); err != nil {
+		return "", err
+	}
+	// The README URL is HOME/-/blob/REF/FILE
+	i := strings.Index(p.ReadmeURL, "/-/blob/")
+	if i < 0 {
+		return "", nil
+	}
+	ref, file := p.ReadmeURL[i+len("/-/blob/"):], ""
+	if j := strings.IndexByte(ref, '/'); j >= 0 {
+		ref, file = ref[:j], ref[j+1:]
+	}
+	text, err := forgeDo(http.MethodGet, project+"/repository/files/"+url.PathEscape(file)+"/raw?ref="+url.QueryEscape(ref), header, nil)
+	if err != nil {
+		return "", err
+	}
+	data, err := forgeDo(http.MethodPost, api+"/markdown", header, map[string]interface{}{
+		"text":    string(text),
+		"gfm":     true,
+		"project": repoPath(u),
+	})
+	if err != nil {
+		return "", err
+	}
+	var md struct {
+		HTML string
+	}
+	if err := json.Unmarshal(data, &md); err != nil {
+		return "", err
+	}
+	return template.HTML(md.HTML), nil
+}
+
+func gitlabDescription(u *url.URL) (string, error) {
+	api, header := gitlabAPI(u)
+	var p struct {
+		Description string
+	}
+	err := forgeJSON(api+"/projects/"+url.PathEscape(repoPath(u)), header, &p)
+	return p.Description, err
+}
+
+// giteaAPI returns the URL of the API of the Gitea instance hosting
+// the repository whose home page is u and the headers of the requests.
+func giteaAPI(u *url.URL) (string, http.Header) {
+	header := http.Header{}
+	if token := os.Getenv("GITEA_TOKEN"); token != "" {
+		header.Set("Authorization", "token "+token)
+	}
+	return u.Scheme + "://" + u.Host + "/api/v1", header
+}
+
+func giteaReadme(u *url.URL) (template.HTML, error) {
+	api, header := giteaAPI(u)
+	text, err := forgeDo(http.MethodGet, api+"/repos/"+repoPath(u)+"/raw/README.md", header, nil)
+	if err != nil {
+		return "", err
+	}
+	html, err := forgeDo(http.MethodPost, api+"/markdown", header, map[string]interface{}{
+		"Text":    string(text),
+		"Mode":    "gfm",
+		"Context": u.String(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(html), nil
+}
+
+func giteaDescription(u *url.URL) (string, error) {
+	api, header := giteaAPI(u)
+	var repo struct {
+		Description string
+	}
+	err := forgeJSON(api+"/repos/"+repoPath(u), header, &repo)
+	return repo.Description, err
+}
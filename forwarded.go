@@ -0,0 +1,89 @@
+package metaimport
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxy reports whether ip is the address of a trusted reverse
+// proxy.
+func (conf *Config) trustedProxy(ip net.IP) bool {
+	return containsIP(conf.trustedNets, ip)
+}
+
+// TrustsProxyProtocol reports whether the PROXY protocol header sent
+// by the peer ip gives the address of the client, which is the case of
+// all the peers unless the trusted proxies are set.
+func (conf *Config) TrustsProxyProtocol(ip net.IP) bool {
+	return len(conf.trustedNets) == 0 || conf.trustedProxy(ip)
+}
+
+// unixConn reports whether r has been received on a Unix domain
+// socket.
+func unixConn(r *http.Request) bool {
+	_, ok := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr)
+	return ok
+}
+
+// clientIP returns the address of the client which sent r, nil if it
+// can't be determined. If r comes from a trusted proxy, the addresses
+// given by the Forwarded header, or by the X-Forwarded-For header if
+// it's missing, are walked from the last one, the address of the
+// client being the first one which is not trusted.
+func (conf *Config) clientIP(r *http.Request) net.IP {
+	ip := remoteIP(r)
+	if !conf.trustedProxy(ip) && !(conf.trustUnix && unixConn(r)) {
+		return ip
+	}
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHop(hops[i])
+		if hop == nil {
+			// Unknown or obfuscated, the hops before can't be
+			// trusted
+			break
+		}
+		ip = hop
+		if !conf.trustedProxy(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardedFor returns the addresses of the hops, from the client to
+// the last proxy, listed by the for parameters of the Forwarded header
+// of h or, if it's missing, by its X-Forwarded-For header.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, v := range values {
+			for _, elem := range strings.Split(v, ",") {
+				for _, pair := range strings.Split(elem, ";") {
+					name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(name, "for") {
+						hops = append(hops, strings.Trim(value, `"`))
+					}
+				}
+			}
+		}
+		return hops
+	}
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseHop parses the address of a hop, which may be followed by a
+// port, IPv6 addresses being then enclosed in square brackets. nil is
+// returned if it's not an IP address.
+func parseHop(s string) net.IP {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+}
@@ -0,0 +1,74 @@
+package metaimport
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// functionConfigEnv is the environment variable naming the
+	// configuration of Function
+	functionConfigEnv = "METAIMPORT_CONFIG"
+	// functionConfigDataEnv is the environment variable holding the
+	// configuration of Function
+	functionConfigDataEnv = "METAIMPORT_CONFIG_DATA"
+	// defaultFunctionConfig is the configuration of Function when
+	// functionConfigEnv is not set, shipped with its source
+	defaultFunctionConfig = "metaimport.yaml"
+)
+
+var function struct {
+	once    sync.Once
+	handler *Handler
+	err     error
+}
+
+// loadFunctionConfig loads the configuration of Function.
+func loadFunctionConfig() (*Config, error) {
+	if data := os.Getenv(functionConfigDataEnv); data != "" {
+		// JSON being a subset of YAML, both are accepted
+		conf, err := ParseConfig(strings.NewReader(data), "yaml")
+		if err != nil {
+			return nil, err
+		}
+		return conf, conf.prepare()
+	}
+	name := os.Getenv(functionConfigEnv)
+	if name == "" {
+		name = defaultFunctionConfig
+	}
+	return LoadConfig(name)
+}
+
+// Function serves the import paths as a Google Cloud Function, the
+// entry point of the function being Function. The configuration is
+// loaded when the first request is received, either from the
+// environment variable METAIMPORT_CONFIG_DATA holding it in YAML or
+// JSON or from the file, the directory or the URL named by the
+// environment variable METAIMPORT_CONFIG, which defaults to the file
+// metaimport.yaml deployed with the source of the function. The access
+// log records are written to the standard output.
+func Function(w http.ResponseWriter, r *http.Request) {
+	function.once.Do(func() {
+		conf, err := loadFunctionConfig()
+		if err != nil {
+			function.err = err
+			return
+		}
+		if function.handler, function.err = New(conf); function.err != nil {
+			return
+		}
+		if conf.AccessLog != "none" {
+			function.handler.AccessLog = os.Stdout
+		}
+	})
+	if function.err != nil {
+		slog.ErrorContext(r.Context(), "failed to load configuration", "err", function.err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	function.handler.ServeHTTP(w, r)
+}
@@ -1,3 +1,27 @@
 module github.com/montag451/metaimport
 
-go 1.13
+go 1.23
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/fsnotify/fsnotify v1.10.1
+	github.com/hashicorp/hcl v1.0.0
+	github.com/quic-go/quic-go v0.48.2
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/crypto v0.28.0
+	golang.org/x/mod v0.21.0
+	golang.org/x/net v0.28.0
+	golang.org/x/sys v0.26.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
+	github.com/quic-go/qpack v0.5.1 // indirect
+	go.uber.org/mock v0.4.0 // indirect
+	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
+	golang.org/x/text v0.19.0 // indirect
+	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
+)
@@ -0,0 +1,205 @@
+package metaimport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Import paths can be defined as ImportPath objects in a Kubernetes
+// cluster, see deploy/kubernetes/crd.yaml. The spec of each object is
+// an import path, written as in the configuration file.
+
+const (
+	k8sGroupVersion   = "metaimport.montag451.github.io/v1"
+	k8sResource       = "importpaths"
+	k8sServiceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+	k8sRetryDelay     = 5 * time.Second
+)
+
+// Kubernetes holds the settings used to find the ImportPath objects.
+type Kubernetes struct {
+	Namespace string `doc:"Namespace holding the ImportPath objects, defaults to the namespace of the pod"`
+}
+
+type k8sImportPath struct {
+	Metadata struct {
+		Name string
+	}
+	Spec json.RawMessage
+}
+
+var k8sClient struct {
+	once   sync.Once
+	client *http.Client
+	err    error
+}
+
+// k8sHTTPClient returns a client trusting the CA of the cluster.
+func k8sHTTPClient() (*http.Client, error) {
+	k8sClient.once.Do(func() {
+		ca, err := ioutil.ReadFile(k8sServiceAccount + "/ca.crt")
+		if err != nil {
+			k8sClient.err = err
+			return
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			k8sClient.err = errors.New("conf: bad kubernetes CA certificate")
+			return
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		k8sClient.client = &http.Client{Transport: transport}
+	})
+	return k8sClient.client, k8sClient.err
+}
+
+// get sends a GET request to the Kubernetes API server for the
+// import paths of the namespace. The credentials of the service
+// account of the pod are used.
+func (k *Kubernetes) get(query url.Values) (*http.Response, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("conf: not running inside a kubernetes cluster")
+	}
+	ns := k.Namespace
+	if ns == "" {
+		data, err := ioutil.ReadFile(k8sServiceAccount + "/namespace")
+		if err != nil {
+			return nil, err
+		}
+		ns = strings.TrimSpace(string(data))
+	}
+	client, err := k8sHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	// The token is read for each request as it's rotated by the
+	// kubelet
+	token, err := ioutil.ReadFile(k8sServiceAccount + "/token")
+	if err != nil {
+		return nil, err
+	}
+	u := &url.URL{
+		Scheme:   "https",
+		Host:     net.JoinHostPort(host, port),
+		Path:     "/apis/" + k8sGroupVersion + "/namespaces/" + ns + "/" + k8sResource,
+		RawQuery: query.Encode(),
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("conf: failed to list kubernetes import paths: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// addPaths appends the import paths defined in the cluster to conf
+// and records the resource version of the list.
+func (k *Kubernetes) addPaths(conf *Config) error {
+	resp, err := k.get(nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Metadata struct {
+			ResourceVersion string
+		}
+		Items []k8sImportPath
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return fmt.Errorf("conf: bad kubernetes response: %s", err)
+	}
+	for _, item := range list.Items {
+		c, err := parseImportPath(item.Spec, "json")
+		if err != nil {
+			return fmt.Errorf("importpath %s: %s", item.Metadata.Name, err)
+		}
+		mergeConfig(conf, c)
+	}
+	conf.k8sVersion = list.Metadata.ResourceVersion
+	return nil
+}
+
+// watch blocks until an import path of the namespace is added,
+// modified or deleted after version. It returns io.EOF if the API
+// server ends the watch before that.
+func (k *Kubernetes) watch(version string) error {
+	resp, err := k.get(url.Values{
+		"watch":           {"1"},
+		"resourceVersion": {version},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var ev struct {
+			Type   string
+			Object struct {
+				Message string
+			}
+		}
+		if err := decoder.Decode(&ev); err != nil {
+			return err
+		}
+		switch ev.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			return nil
+		case "ERROR":
+			// Most likely the resource version is too old, a
+			// reload lists the import paths again
+			slog.Warn("kubernetes watch error", "message", ev.Object.Message)
+			return nil
+		}
+	}
+}
+
+// watchImportPaths reloads the configuration name, whose current
+// version is conf, each time an import path is added, modified or
+// deleted in the cluster and calls fn with the new version.
+func watchImportPaths(name string, conf *Config, fn func(*Config)) {
+	for conf.Kubernetes != nil {
+		err := conf.Kubernetes.watch(conf.k8sVersion)
+		if err == io.EOF {
+			// The API server ends the watches after a while, nothing
+			// was modified
+			continue
+		}
+		if err != nil {
+			slog.Error("failed to watch kubernetes import paths", "err", err)
+			time.Sleep(k8sRetryDelay)
+			continue
+		}
+		c := reload(name, fn)
+		if c == nil {
+			// The reload failed, don't retry immediately
+			time.Sleep(k8sRetryDelay)
+			continue
+		}
+		conf = c
+	}
+}
@@ -0,0 +1,338 @@
+package metaimport
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The configuration stored in a KV store is made of an optional
+// PREFIX/config key holding the global settings and one
+// PREFIX/paths/NAME key per import path. The format of each key is
+// deduced from its extension, JSON being the default.
+
+const (
+	kvConfigKey   = "config"
+	kvPathsPrefix = "paths/"
+	kvRetryDelay  = 5 * time.Second
+	kvConsulWait  = "5m"
+	// kvTimeout is the time after which the answer of a KV store to a
+	// request which is not blocking is no longer waited for
+	kvTimeout = 10 * time.Second
+)
+
+// kvClient sends the requests to the KV stores, except the blocking
+// ones waiting for modifications which are sent by kvWatchClient.
+var (
+	kvClient      = &http.Client{Timeout: kvTimeout}
+	kvWatchClient = &http.Client{}
+)
+
+type kvPair struct {
+	key   string
+	value []byte
+}
+
+// isKVURL reports whether the configuration name refers to a KV
+// store. The supported schemes are consul, etcd and their
+// consul+https and etcd+https variants.
+func isKVURL(name string) bool {
+	for _, scheme := range []string{"consul://", "consul+https://", "etcd://", "etcd+https://"} {
+		if strings.HasPrefix(name, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// kvBackend returns the name of the KV store and the base URL of its
+// HTTP API for the configuration URL u.
+func kvBackend(u *url.URL) (string, *url.URL) {
+	backend := strings.TrimSuffix(u.Scheme, "+https")
+	api := &url.URL{Scheme: "http", Host: u.Host}
+	if strings.HasSuffix(u.Scheme, "+https") {
+		api.Scheme = "https"
+	}
+	return backend, api
+}
+
+// kvPrefix returns the prefix of the keys holding the configuration
+// referred to by u, with a trailing slash.
+func kvPrefix(u *url.URL) string {
+	p := strings.Trim(u.Path, "/")
+	if p == "" {
+		return ""
+	}
+	return p + "/"
+}
+
+// fetchKVConfig reads the configuration stored in the KV store
+// referred to by name. The index or revision of the store is recorded
+// as the entity tag of the configuration.
+func fetchKVConfig(name string) (*Config, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	var pairs []kvPair
+	var index string
+	if backend, _ := kvBackend(u); backend == "consul" {
+		pairs, index, err = consulList(u, "")
+	} else {
+		pairs, index, err = etcdList(u)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conf, err := configFromKV(kvPrefix(u), pairs)
+	if err != nil {
+		return nil, err
+	}
+	conf.etag = index
+	return conf, nil
+}
+
+// configFromKV builds a configuration from the pairs stored under
+// prefix.
+func configFromKV(prefix string, pairs []kvPair) (*Config, error) {
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].key < pairs[j].key })
+	conf := &Config{}
+	for _, p := range pairs {
+		key := strings.TrimPrefix(p.key, prefix)
+		format := configFormat(key)
+		var c *Config
+		var err error
+		switch {
+		case strings.TrimSuffix(key, path.Ext(key)) == kvConfigKey:
+			c, err = parseConfig(bytes.NewReader(p.value), format, false)
+		case strings.HasPrefix(key, kvPathsPrefix) && len(key) > len(kvPathsPrefix):
+			c, err = parseImportPath(p.value, format)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", p.key, err)
+		}
+		mergeConfig(conf, c)
+	}
+	return conf, nil
+}
+
+// consulList lists the keys under the prefix of u. If index is not
+// empty, the call blocks until the keys are modified or the wait
+// time expires.
+func consulList(u *url.URL, index string) ([]kvPair, string, error) {
+	_, api := kvBackend(u)
+	api.Path = "/v1/kv/" + kvPrefix(u)
+	q := url.Values{"recurse": {"true"}}
+	if index != "" {
+		q.Set("index", index)
+		q.Set("wait", kvConsulWait)
+	}
+	api.RawQuery = q.Encode()
+	req, err := http.NewRequest(http.MethodGet, api.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	client := kvClient
+	if index != "" {
+		client = kvWatchClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	newIndex := resp.Header.Get("X-Consul-Index")
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, newIndex, nil
+	default:
+		return nil, "", fmt.Errorf("conf: failed to list consul keys: %s", resp.Status)
+	}
+	var entries []struct {
+		Key   string
+		Value []byte
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, "", fmt.Errorf("conf: bad consul response: %s", err)
+	}
+	pairs := make([]kvPair, len(entries))
+	for i, e := range entries {
+		pairs[i] = kvPair{e.Key, e.Value}
+	}
+	return pairs, newIndex, nil
+}
+
+// etcdRangeEnd returns the end of the range holding all the keys
+// starting with prefix.
+func etcdRangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+// etcdCall calls the endpoint of the etcd v3 JSON gateway with client.
+// The credentials held by u, if any, are used to authenticate.
+func etcdCall(client *http.Client, u *url.URL, endpoint string, body interface{}) (*http.Response, error) {
+	_, api := kvBackend(u)
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	api.Path = endpoint
+	req, err := http.NewRequest(http.MethodPost, api.String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if u.User != nil && endpoint != "/v3/auth/authenticate" {
+		password, _ := u.User.Password()
+		resp, err := etcdCall(kvClient, u, "/v3/auth/authenticate", map[string]string{
+			"name":     u.User.Username(),
+			"password": password,
+		})
+		if err != nil {
+			return nil, err
+		}
+		var auth struct{ Token string }
+		err = json.NewDecoder(resp.Body).Decode(&auth)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("conf: bad etcd response: %s", err)
+		}
+		req.Header.Set("Authorization", auth.Token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("conf: etcd call to %s failed: %s", endpoint, resp.Status)
+	}
+	return resp, nil
+}
+
+// etcdList lists the keys under the prefix of u and returns them
+// along with the revision of the store.
+func etcdList(u *url.URL) ([]kvPair, string, error) {
+	prefix := kvPrefix(u)
+	resp, err := etcdCall(kvClient, u, "/v3/kv/range", map[string][]byte{
+		"key":       []byte(prefix),
+		"range_end": etcdRangeEnd(prefix),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var r struct {
+		Header struct{ Revision string }
+		Kvs    []struct {
+			Key   []byte
+			Value []byte
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, "", fmt.Errorf("conf: bad etcd response: %s", err)
+	}
+	pairs := make([]kvPair, len(r.Kvs))
+	for i, kv := range r.Kvs {
+		pairs[i] = kvPair{string(kv.Key), kv.Value}
+	}
+	return pairs, r.Header.Revision, nil
+}
+
+// etcdWatch blocks until a key under the prefix of u is modified
+// after revision.
+func etcdWatch(u *url.URL, revision string) error {
+	prefix := kvPrefix(u)
+	rev, _ := strconv.ParseInt(revision, 10, 64)
+	resp, err := etcdCall(kvWatchClient, u, "/v3/watch", map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            []byte(prefix),
+			"range_end":      etcdRangeEnd(prefix),
+			"start_revision": strconv.FormatInt(rev+1, 10),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var r struct {
+			Result struct {
+				Events []json.RawMessage
+			}
+			Error *struct{ Message string }
+		}
+		if err := decoder.Decode(&r); err != nil {
+			return err
+		}
+		if r.Error != nil {
+			return fmt.Errorf("conf: etcd watch failed: %s", r.Error.Message)
+		}
+		if len(r.Result.Events) > 0 {
+			return nil
+		}
+	}
+}
+
+// watchKV waits for modifications of the configuration stored in the
+// KV store referred to by name, whose current version is conf, and
+// calls fn with the new version each time it is modified.
+func watchKV(name string, conf *Config, fn func(*Config)) {
+	u, err := url.Parse(name)
+	if err != nil {
+		slog.Error("failed to watch configuration", "name", name, "err", err)
+		return
+	}
+	backend, _ := kvBackend(u)
+	for {
+		index := conf.etag
+		if backend == "consul" {
+			var newIndex string
+			_, newIndex, err = consulList(u, index)
+			if err == nil && newIndex == index {
+				continue
+			}
+		} else {
+			err = etcdWatch(u, index)
+		}
+		if err != nil {
+			slog.Error("failed to watch configuration", "name", name, "err", err)
+			time.Sleep(kvRetryDelay)
+			continue
+		}
+		c, err := fetchKVConfig(name)
+		if err == nil {
+			err = c.prepare()
+		}
+		if err != nil {
+			slog.Error("failed to reload configuration", "name", name, "err", err)
+			time.Sleep(kvRetryDelay)
+			continue
+		}
+		fn(c)
+		conf = c
+	}
+}
@@ -0,0 +1,186 @@
+package metaimport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/semver"
+)
+
+// defaultLatestTTL is the time during which the latest version of a
+// repository is cached when the configuration doesn't say otherwise.
+const defaultLatestTTL = 5 * time.Minute
+
+// latestPrefix is the path under which the latest versions of the
+// packages are served.
+const latestPrefix = "/-/latest/"
+
+// lsRemoteTimeout is the time after which the tags of a repository are
+// no longer waited for, as the answers of the forges.
+const lsRemoteTimeout = 10 * time.Second
+
+// latestVersion returns the highest version among versions, which
+// must be canonical: the highest release or the highest pre-release if
+// there is none. An empty string is returned if versions is empty.
+func latestVersion(versions []string) string {
+	latest := ""
+	for _, v := range versions {
+		switch {
+		case latest == "":
+			latest = v
+		case semver.Prerelease(v) == "" && semver.Prerelease(latest) != "":
+			latest = v
+		case (semver.Prerelease(v) == "") == (semver.Prerelease(latest) == "") && semver.Compare(v, latest) > 0:
+			latest = v
+		}
+	}
+	return latest
+}
+
+// lsRemoteLatest returns the latest version tagged in the git
+// repository repo, listing its tags with git ls-remote, which is
+// killed when ctx is done or after lsRemoteTimeout.
+func lsRemoteLatest(ctx context.Context, repo string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, lsRemoteTimeout)
+	defer cancel()
+	out, err := gitContext(ctx, "", "ls-remote", "--tags", "--refs", "--", repo)
+	if err != nil {
+		return "", err
+	}
+	var versions []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		v := strings.TrimPrefix(fields[1], "refs/tags/")
+		if semver.Canonical(v) == v {
+			versions = append(versions, v)
+		}
+	}
+	v := latestVersion(versions)
+	if v == "" {
+		return "", errors.New("no tagged version")
+	}
+	return v, nil
+}
+
+// latest returns the latest version tagged in the git repository
+// repo, cached for ttl, for the request whose context is ctx. An empty
+// string is returned if it can't be determined.
+func latest(ctx context.Context, repo string, ttl time.Duration) string {
+	return cachedForgeInfo("latest version", repo, ttl, func(*url.URL) (string, error) {
+		return lsRemoteLatest(ctx, repo)
+	})
+}
+
+// latestTTL returns the time during which the latest versions are
+// cached.
+func (conf *Config) latestTTL() time.Duration {
+	if ttl := time.Duration(conf.LatestTTL); ttl > 0 {
+		return ttl
+	}
+	return defaultLatestTTL
+}
+
+// latestInfo is the JSON object describing the latest version of a
+// package.
+type latestInfo struct {
+	Prefix  string `json:"prefix"`
+	Repo    string `json:"repo"`
+	Version string `json:"version"`
+}
+
+// serveLatest writes the latest version of the repository of the
+// package following the latest prefix in the path of r as JSON.
+func (h *Handler) serveLatest(w http.ResponseWriter, r *http.Request) {
+	pkgName := strings.TrimPrefix(r.URL.Path, latestPrefix)
+	mi, err := h.resolver.resolve(r.Context(), pkgName, nil, true)
+	if err != nil || mi.VCS != "git" || !h.disclosed(mi.Index, r) {
+		http.NotFound(w, r)
+		return
+	}
+	v := latest(r.Context(), mi.Repo, h.conf.latestTTL())
+	if v == "" {
+		http.Error(w, "no tagged version", http.StatusNotFound)
+		return
+	}
+	data, err := json.MarshalIndent(latestInfo{Prefix: mi.Prefix, Repo: mi.Repo, Version: v}, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// badgePrefix is the path under which the badges of the packages are
+// served.
+const badgePrefix = "/-/badge/"
+
+// badgeTemplate renders a badge in the style of shields.io. The width
+// of the texts is estimated, the SVG being rendered with a generic
+// font.
+const badgeTemplate = `<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[2]s: %[3]s">
+  <title>%[2]s: %[3]s</title>
+  <linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+  <clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>
+  <g clip-path="url(#r)">
+    <rect width="%[4]d" height="20" fill="#555"/>
+    <rect x="%[4]d" width="%[5]d" height="20" fill="%[6]s"/>
+    <rect width="%[1]d" height="20" fill="url(#s)"/>
+  </g>
+  <g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+    <text x="%[7]d" y="15" fill="#010101" fill-opacity=".3">%[2]s</text>
+    <text x="%[7]d" y="14">%[2]s</text>
+    <text x="%[8]d" y="15" fill="#010101" fill-opacity=".3">%[3]s</text>
+    <text x="%[8]d" y="14">%[3]s</text>
+  </g>
+</svg>
+`
+
+// badge returns the SVG badge showing value next to label, on a
+// background of the given color.
+func badge(label, value, color string) []byte {
+	textWidth := func(s string) int {
+		return 7*len(s) + 10
+	}
+	lw, vw := textWidth(label), textWidth(value)
+	return []byte(fmt.Sprintf(badgeTemplate, lw+vw, html.EscapeString(label), html.EscapeString(value), lw, vw, color, lw/2, lw+vw/2))
+}
+
+// serveBadge writes the badge showing the latest version of the
+// repository of the package whose name follows the badge prefix in the
+// path of r, with the .svg extension.
+func (h *Handler) serveBadge(w http.ResponseWriter, r *http.Request) {
+	pkgName, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, badgePrefix), ".svg")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	mi, err := h.resolver.resolve(r.Context(), pkgName, nil, true)
+	if err != nil || mi.VCS != "git" || !h.disclosed(mi.Index, r) {
+		http.NotFound(w, r)
+		return
+	}
+	ttl := h.conf.latestTTL()
+	v, color := latest(r.Context(), mi.Repo, ttl), "#007ec6"
+	switch {
+	case v == "":
+		v, color = "unknown", "#9f9f9f"
+	case semver.Prerelease(v) != "":
+		color = "#fe7d37"
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(ttl.Seconds())))
+	w.WriteHeader(http.StatusOK)
+	w.Write(badge("version", v, color))
+}
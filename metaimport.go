@@ -0,0 +1,928 @@
+// Package metaimport serves the go-import meta tags of vanity import
+// paths, as described by a configuration.
+package metaimport
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var mainTemplate = template.Must(template.New("main").Parse(`
+{{- /* This is the template used to render the HTML page */ -}}
+<html>
+  <head>
+    <meta name="go-import" content="{{ .Prefix }} {{ .VCS }} {{ .Repo }}">
+    {{- with .Source }}
+    <meta name="go-source" content="{{ $.Prefix }} {{ .Home }} {{ .Directory }} {{ .File }}">
+    {{- end }}
+  </head>
+  <body>
+  </body>
+</html>
+`))
+
+// landingTemplate renders the page shown to the browsers, which don't
+// send go-get queries.
+var landingTemplate = template.Must(mainTemplate.New("landing").Parse(`
+{{- /* This is the template used to render the landing page */ -}}
+<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <meta name="go-import" content="{{ .Prefix }} {{ .VCS }} {{ .Repo }}">
+    {{- with .Source }}
+    <meta name="go-source" content="{{ $.Prefix }} {{ .Home }} {{ .Directory }} {{ .File }}">
+    {{- end }}
+    <title>{{ .Package }}</title>
+    <meta property="og:type" content="website">
+    <meta property="og:title" content="{{ .Package }}">
+    <meta name="twitter:card" content="summary">
+    <meta name="twitter:title" content="{{ .Package }}">
+    {{- with .Description }}
+    <meta name="description" content="{{ . }}">
+    <meta property="og:description" content="{{ . }}">
+    <meta name="twitter:description" content="{{ . }}">
+    {{- end }}
+  </head>
+  <body>
+    <h1>{{ .Package }}</h1>
+    {{- with .Description }}
+    <p>{{ . }}</p>
+    {{- end }}
+    <p>Install it with:</p>
+    <pre>go get {{ .Package }}</pre>
+    {{- if .Source }}
+    <p>Source: <a href="{{ .Source.Home }}">{{ .Source.Home }}</a></p>
+    {{- else }}
+    <p>Repository: <a href="{{ .Repo }}">{{ .Repo }}</a></p>
+    {{- end }}
+    {{- with .Readme }}
+    <div class="readme">
+      {{ . }}
+    </div>
+    {{- end }}
+  </body>
+</html>
+`))
+
+// indexTemplate renders the page listing the import paths of a host.
+var indexTemplate = template.Must(mainTemplate.New("index").Parse(`
+{{- /* This is the template used to render the index page */ -}}
+<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <title>{{ .Host }}</title>
+  </head>
+  <body>
+    <h1>{{ .Host }}</h1>
+    <ul>
+      {{- range .Paths }}
+      <li>
+        {{- if .Wildcard }}
+        {{ .Prefix }}/*
+        {{- else }}
+        <a href="/{{ .Path }}">{{ .Prefix }}</a>
+        (<a href="https://pkg.go.dev/{{ .Prefix }}">docs</a>
+        {{- with .Repo }}, <a href="{{ . }}">repository</a>{{ end }})
+        {{- end }}
+        {{- with .Description }} - {{ . }}{{ end }}
+      </li>
+      {{- end }}
+    </ul>
+  </body>
+</html>
+`))
+
+// notFoundTemplate renders the page served when no import path
+// matches the requested package.
+var notFoundTemplate = template.Must(mainTemplate.New("notfound").Parse(`
+{{- /* This is the template used to render the not found page */ -}}
+<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <title>{{ .Package }} not found</title>
+  </head>
+  <body>
+    <h1>Not found</h1>
+    <p>No import path matches {{ .Package }}, see the <a href="/">list of the import paths</a> of {{ .Host }}.</p>
+  </body>
+</html>
+`))
+
+// notFoundPage is the data used to render the not found page of the
+// package Package.
+type notFoundPage struct {
+	Host    string
+	Package string
+}
+
+// indexPage is the data used to render the index page of the host
+// Host.
+type indexPage struct {
+	Host  string
+	Paths []indexEntry
+}
+
+// indexEntry describes an import path on the index page. Path is the
+// prefix without the host. The packages of a wildcard import path
+// have more components than the prefix or are matched by a regexp, so
+// it has no page of its own.
+type indexEntry struct {
+	Prefix      string
+	Path        string
+	Repo        string
+	Description string
+	Wildcard    bool
+}
+
+// index returns the data of the index page of the host of r, listing
+// the import paths disclosed to its client.
+func (h *Handler) index(r *http.Request) *indexPage {
+	host := r.Host
+	page := &indexPage{Host: host}
+	for i, p := range h.conf.Paths {
+		components := strings.Split(p.Prefix, "/")
+		if components[0] != host || !h.disclosed(i, r) {
+			continue
+		}
+		e := indexEntry{
+			Prefix:      strings.TrimSuffix(p.Prefix, "/"),
+			Path:        strings.Join(components[1:], "/"),
+			Description: p.Description,
+			Wildcard:    p.NbComponents > len(components) || p.re != nil,
+		}
+		if p.re != nil {
+			e.Prefix = p.Regexp
+		}
+		if !e.Wildcard {
+			mi, err := h.resolver.Resolve(p.Prefix)
+			if err != nil || mi.Index != i {
+				// Broken or shadowed by another import path
+				continue
+			}
+			e.Repo = mi.Repo
+			if mi.Source != nil {
+				e.Repo = mi.Source.Home
+			}
+		}
+		page.Paths = append(page.Paths, e)
+	}
+	sort.Slice(page.Paths, func(i, j int) bool {
+		return page.Paths[i].Prefix < page.Paths[j].Prefix
+	})
+	return page
+}
+
+// sitemap is the sitemap of the landing pages of a host.
+type sitemap struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc string `xml:"loc"`
+}
+
+// serveSitemap writes the sitemap of the landing pages of the import
+// paths of the host of r. The pages are assumed to be served over
+// HTTPS, as required by the go command.
+func (h *Handler) serveSitemap(w http.ResponseWriter, r *http.Request) {
+	sm := sitemap{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	for _, e := range h.index(r).Paths {
+		if !e.Wildcard {
+			sm.URLs = append(sm.URLs, sitemapURL{"https://" + e.Prefix})
+		}
+	}
+	data, err := xml.MarshalIndent(sm, "", "  ")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to render the sitemap", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+// staticPrefix is the path under which the static assets are served.
+const staticPrefix = "/-/static/"
+
+// serveStatic serves the static asset requested by r. Directories are
+// not listed.
+func (h *Handler) serveStatic(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, staticPrefix)
+	if h.conf.Static == "" || name == "" || strings.HasSuffix(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := http.Dir(h.conf.Static).Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+// wellKnownPrefix is the path under which the well-known files are
+// served.
+const wellKnownPrefix = "/.well-known/"
+
+// serveWellKnown serves the well-known file requested by r.
+func (h *Handler) serveWellKnown(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, wellKnownPrefix)
+	content, ok := h.conf.WellKnown[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(content))
+}
+
+// serveRobots writes the robots.txt of the host of r.
+func (h *Handler) serveRobots(w http.ResponseWriter, r *http.Request) {
+	robots := h.conf.Robots
+	if robots == "" {
+		b := &strings.Builder{}
+		b.WriteString("User-agent: *\nAllow: /$\n")
+		for _, e := range h.index(r).Paths {
+			if !e.Wildcard && e.Path != "" {
+				fmt.Fprintf(b, "Allow: /%s\n", e.Path)
+			}
+		}
+		fmt.Fprintf(b, "Disallow: /\n\nSitemap: https://%s/sitemap.xml\n", r.Host)
+		robots = b.String()
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(robots))
+}
+
+// pathInfo describes an import path in the response of /-/paths. Repo
+// is the repository of the packages matching the prefix, it's empty
+// for an import path whose packages have more components than its
+// prefix or matched by a regexp.
+type pathInfo struct {
+	Prefix       string  `json:"prefix"`
+	Regexp       string  `json:"regexp,omitempty"`
+	NbComponents int     `json:"nb_components"`
+	VCS          string  `json:"vcs"`
+	RepoTemplate string  `json:"repo_template"`
+	Repo         string  `json:"repo,omitempty"`
+	Source       *Source `json:"source,omitempty"`
+	Shadowed     bool    `json:"shadowed,omitempty"`
+}
+
+// servePaths writes the import paths of the configuration disclosed to
+// the client which sent r as JSON.
+func (h *Handler) servePaths(w http.ResponseWriter, r *http.Request) {
+	paths := []pathInfo{}
+	for i, p := range h.conf.Paths {
+		if !h.disclosed(i, r) {
+			continue
+		}
+		info := pathInfo{
+			Prefix:       p.Prefix,
+			Regexp:       p.Regexp,
+			NbComponents: p.NbComponents,
+			VCS:          p.VCS,
+			RepoTemplate: p.RepoTemplate,
+		}
+		if p.re == nil && p.NbComponents == len(strings.Split(p.Prefix, "/")) {
+			mi, err := h.resolver.Resolve(p.Prefix)
+			switch {
+			case err != nil:
+				slog.ErrorContext(r.Context(), "failed to execute template", "package", p.Prefix, "err", err)
+			case mi.Index != i:
+				info.Shadowed = true
+			default:
+				info.Repo = mi.Repo
+				info.Source = mi.Source
+			}
+		}
+		paths = append(paths, info)
+	}
+	data, err := json.MarshalIndent(map[string]interface{}{"paths": paths}, "", "  ")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to render the import paths", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// landingPage is the data used to render the landing page of the
+// package Package. Readme is the rendered README of the repository,
+// if it's shown.
+type landingPage struct {
+	MetaImport
+	Package     string
+	Description string
+	Readme      template.HTML
+}
+
+// redirectTargets holds the valid values of the redirect settings.
+var redirectTargets = map[string]bool{
+	"landing":    true,
+	"pkg.go.dev": true,
+	"repo":       true,
+}
+
+// redirectURL returns the URL the browsers asking for the package
+// pkgName, resolved into mi, are redirected to, an empty string if the
+// landing page should be shown.
+func (conf *Config) redirectURL(mi *MetaImport, pkgName string) (string, error) {
+	p := &conf.Paths[mi.Index]
+	redirect := conf.Redirect
+	if p.Redirect != "" {
+		redirect = p.Redirect
+	}
+	switch redirect {
+	case "pkg.go.dev":
+		return "https://pkg.go.dev/" + pkgName, nil
+	case "repo":
+		if p.BrowseTemplate == "" {
+			return mi.Repo, nil
+		}
+		u := &strings.Builder{}
+		name := browseTemplateName(templateNameForImportPath(mi.Index))
+		if err := conf.tmpl.ExecuteTemplate(u, name, p.templateData(pkgName)); err != nil {
+			return "", err
+		}
+		return u.String(), nil
+	}
+	return "", nil
+}
+
+// templateData returns the data the templates of p are executed with
+// for the package pkgName matched by p: the submatches of its regexp,
+// if any, or the components of pkgName.
+func (p *ImportPath) templateData(pkgName string) []string {
+	if p.re != nil {
+		if m := p.re.FindStringSubmatch(pkgName); m != nil {
+			m[0] = strings.TrimSuffix(m[0], "/")
+			return m
+		}
+	}
+	return strings.Split(pkgName, "/")
+}
+
+// protected reports whether the import path p is only disclosed to
+// some clients.
+func (p *ImportPath) protected() bool {
+	return p.ACL != nil || p.Auth != nil
+}
+
+// protected reports whether some import paths of conf are only
+// disclosed to some clients.
+func (conf *Config) protected() bool {
+	for i := range conf.Paths {
+		if conf.Paths[i].protected() {
+			return true
+		}
+	}
+	return false
+}
+
+// disclosed reports whether the import path i is disclosed to the
+// client which sent r, the client being allowed by its ACL and
+// authorized by its credentials.
+func (h *Handler) disclosed(i int, r *http.Request) bool {
+	p := &h.conf.Paths[i]
+	return p.ACL.allowed(h.conf.clientIP(r)) && p.Auth.authorized(r)
+}
+
+// remoteIP returns the address of the client which sent r, nil if it
+// can't be determined.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// isBrowser reports whether the request r has most likely been sent
+// by a browser.
+func isBrowser(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func init() {
+	mainTemplate.Funcs(template.FuncMap{
+		"join": func(elems []string) string {
+			return path.Join(elems...)
+		},
+		"latest": func(repo string) string {
+			return latest(context.Background(), repo, defaultLatestTTL)
+		},
+	})
+}
+
+// MetaImport holds the content of the go-import meta tag of a package.
+type MetaImport struct {
+	Prefix string
+	VCS    string
+	Repo   string
+	// Source holds the content of the go-source meta tag, nil if
+	// the import path doesn't define it.
+	Source *Source
+	// Index is the index of the matching import path in the paths
+	// of the configuration.
+	Index int
+}
+
+// Source holds the URLs of the go-source meta tag of a package.
+type Source struct {
+	Home      string `json:"home"`
+	Directory string `json:"directory"`
+	File      string `json:"file"`
+}
+
+func templateNameForImportPath(i int) string {
+	return "path-" + strconv.Itoa(i)
+}
+
+// browseTemplateName returns the name of the browse template of the
+// import path whose repo template is named name.
+func browseTemplateName(name string) string {
+	return name + "-browse"
+}
+
+// proxyTemplateName returns the name of the proxy template of the
+// import path whose repo template is named name.
+func proxyTemplateName(name string) string {
+	return name + "-proxy"
+}
+
+// templateNames returns the names of the templates of the import path
+// i.
+func (conf *Config) templateNames(i int) []string {
+	p := &conf.Paths[i]
+	name := templateNameForImportPath(i)
+	names := []string{name}
+	if p.BrowseTemplate != "" {
+		names = append(names, browseTemplateName(name))
+	}
+	if p.ProxyTemplate != "" {
+		names = append(names, proxyTemplateName(name))
+	}
+	if p.Source != nil {
+		for j := range p.Source.templates() {
+			names = append(names, sourceTemplateName(name, j))
+		}
+	}
+	return names
+}
+
+// sourceTemplateName returns the name of the jth source template of
+// the import path whose repo template is named name.
+func sourceTemplateName(name string, j int) string {
+	return name + "-source-" + strconv.Itoa(j)
+}
+
+// ErrNoMatch is returned when no import path matches a package.
+var ErrNoMatch = errors.New("no matching import path")
+
+// Resolver resolves package names into go-import meta data using the
+// import paths of a configuration.
+type Resolver struct {
+	conf *Config
+}
+
+// NewResolver returns a resolver using the import paths of conf. The
+// default values of conf are filled in and its repo templates are
+// compiled if that has not already been done by LoadConfig.
+func NewResolver(conf *Config) (*Resolver, error) {
+	if conf.tmpl == nil {
+		if err := conf.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return &Resolver{conf: conf}, nil
+}
+
+// Resolve returns the go-import meta data of the package pkgName. The
+// import path with the longest prefix matching pkgName is used. If
+// none matches, ErrNoMatch is returned.
+func (r *Resolver) Resolve(pkgName string) (MetaImport, error) {
+	return r.ResolveFor(pkgName, nil)
+}
+
+// ResolveFor is like Resolve but the import paths in mod mode point
+// the client whose address is ip at their repository if it's in one of
+// their vcs networks.
+func (r *Resolver) ResolveFor(pkgName string, ip net.IP) (MetaImport, error) {
+	return r.resolve(context.Background(), pkgName, ip, false)
+}
+
+// resolve implements ResolveFor for the request whose context is ctx,
+// the import paths in mod mode point at their repository if vcs is
+// true.
+func (r *Resolver) resolve(ctx context.Context, pkgName string, ip net.IP, vcs bool) (MetaImport, error) {
+	conf := r.conf
+	components := strings.Split(pkgName, "/")
+	var p *ImportPath
+	pi, pl := 0, 0
+	for i, path := range conf.Paths {
+		reason := ""
+		// The length of the import prefix, matched by the prefix
+		// unless the regexp is set
+		n := len(path.Prefix)
+		var submatches []string
+		if path.re != nil && strings.HasPrefix(pkgName, path.Prefix) {
+			if submatches = path.re.FindStringSubmatch(pkgName); submatches != nil {
+				submatches[0] = strings.TrimSuffix(submatches[0], "/")
+				n = len(submatches[0])
+			}
+		}
+		switch {
+		case !strings.HasPrefix(pkgName, path.Prefix):
+			reason = "prefix mismatch"
+		case path.re != nil && submatches == nil:
+			reason = "regexp mismatch"
+		case path.re == nil && path.NbComponents > len(components):
+			reason = "too few components"
+		case n < pl:
+			reason = "longer prefix matched"
+		}
+		if reason != "" {
+			slog.DebugContext(ctx, "import path skipped", "package", pkgName, "prefix", path.Prefix, "reason", reason)
+			continue
+		}
+		slog.DebugContext(ctx, "import path matches", "package", pkgName, "prefix", path.Prefix)
+		p = &conf.Paths[i]
+		pi = i
+		pl = n
+	}
+	if p == nil {
+		return MetaImport{}, ErrNoMatch
+	}
+	data := p.templateData(pkgName)
+	prefix := data[0]
+	if p.re == nil {
+		prefix = strings.Join(components[:p.NbComponents], "/")
+	}
+	repo := &strings.Builder{}
+	tmplName := templateNameForImportPath(pi)
+	if err := conf.tmpl.ExecuteTemplate(repo, tmplName, data); err != nil {
+		return MetaImport{Index: pi}, err
+	}
+	mi := MetaImport{
+		Prefix: prefix,
+		VCS:    p.VCS,
+		Repo:   repo.String(),
+		Index:  pi,
+	}
+	if p.Source != nil {
+		var urls [3]string
+		for j := range urls {
+			u := &strings.Builder{}
+			if err := conf.tmpl.ExecuteTemplate(u, sourceTemplateName(tmplName, j), data); err != nil {
+				return MetaImport{Index: pi}, err
+			}
+			urls[j] = u.String()
+		}
+		mi.Source = &Source{Home: urls[0], Directory: urls[1], File: urls[2]}
+	} else if p.Forge != "" {
+		mi.Source = forgeSource(p.Forge, p.Branch, mi.Repo)
+	}
+	if p.Mode == "mod" && !vcs && !p.vcsClient(ip) {
+		proxy := &strings.Builder{}
+		if err := conf.tmpl.ExecuteTemplate(proxy, proxyTemplateName(tmplName), data); err != nil {
+			return MetaImport{Index: pi}, err
+		}
+		mi.VCS = "mod"
+		mi.Repo = proxy.String()
+	}
+	return mi, nil
+}
+
+// Handler serves the go-import meta tags of the import paths of a
+// configuration. The hooks can be set, before the handler is used, to
+// extend the way requests are handled.
+type Handler struct {
+	// OnMatch, if set, is called when the package pkgName matches
+	// the import path p, before the page is written. Returning false
+	// rejects the request, OnMatch is then expected to have written
+	// the response.
+	OnMatch func(w http.ResponseWriter, r *http.Request, pkgName string, p *ImportPath) bool
+	// OnMiss, if set, is called when no import path matches the
+	// package pkgName, in place of replying with a 404 error.
+	OnMiss func(w http.ResponseWriter, r *http.Request, pkgName string)
+	// WrapHandler, if set, wraps the handler serving the requests,
+	// e.g. to add authentication or logging. It's called once, when
+	// the first request is served.
+	WrapHandler func(http.Handler) http.Handler
+	// Stats, if set, counts the resolutions of the packages.
+	Stats *Stats
+	// Metrics, if set, records the metrics of the requests.
+	Metrics *Metrics
+	// Tracer, if set, records a span for each request.
+	Tracer *Tracer
+	// AccessLog, if set, receives an access log record for each
+	// request, as a line of JSON or in the Apache combined log format
+	// if the access log format of the configuration is combined.
+	AccessLog io.Writer
+
+	conf     *Config
+	resolver *Resolver
+	once     sync.Once
+	wrapped  http.Handler
+	modIndex moduleIndexCache
+}
+
+// New returns a handler serving the import paths of conf. The default
+// values of conf are filled in and its repo templates are compiled if
+// that has not already been done by LoadConfig.
+func New(conf *Config) (*Handler, error) {
+	resolver, err := NewResolver(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &Handler{conf: conf, resolver: resolver}, nil
+}
+
+// Config returns the configuration served by h.
+func (h *Handler) Config() *Config {
+	return h.conf
+}
+
+// Resolver returns the resolver used by h.
+func (h *Handler) Resolver() *Resolver {
+	return h.resolver
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.once.Do(func() {
+		h.wrapped = http.HandlerFunc(h.serve)
+		if h.WrapHandler != nil {
+			h.wrapped = h.WrapHandler(h.wrapped)
+		}
+		if c := h.conf.RateLimit; c != nil && (c.Rate > 0 || c.GlobalRate > 0) {
+			h.wrapped = h.limit(newRateLimiter(c), h.wrapped)
+		}
+		if acl := h.conf.ACL; acl != nil {
+			next := h.wrapped
+			h.wrapped = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !acl.allowed(h.conf.clientIP(r)) {
+					http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		}
+		if hdrs := h.conf.Headers; hdrs != nil {
+			next := h.wrapped
+			h.wrapped = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hdrs.set(w.Header())
+				next.ServeHTTP(w, r)
+			})
+		}
+		h.wrapped = h.instrument(h.wrapped)
+	})
+	h.wrapped.ServeHTTP(w, r)
+}
+
+// jsonEndpoints are the paths of the endpoints serving JSON, to which
+// the CORS settings apply.
+var jsonEndpoints = map[string]bool{
+	"/-/paths": true,
+	"/-/stats": true,
+}
+
+// jsonEndpoint reports whether urlPath is the path of an endpoint
+// serving JSON.
+func (h *Handler) jsonEndpoint(urlPath string) bool {
+	return jsonEndpoints[urlPath] || strings.HasPrefix(urlPath, latestPrefix) || h.conf.Proxy != nil && urlPath == h.conf.Proxy.indexPath()
+}
+
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) {
+	if h.jsonEndpoint(r.URL.Path) && h.conf.CORS != nil && h.conf.CORS.handle(w, r) {
+		return
+	}
+	// The body of the responses to the HEAD requests is discarded by
+	// net/http
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if p := h.conf.Proxy; p != nil {
+		if r.URL.Path == p.indexPath() && p.Cache != "" {
+			h.serveModuleIndex(w, r)
+			return
+		}
+		if escaped, op, ok := p.match(r.URL.Path); ok {
+			h.serveProxy(w, r, escaped, op)
+			return
+		}
+	}
+	switch r.URL.Path {
+	case "/-/paths":
+		h.servePaths(w, r)
+		return
+	case "/-/stats":
+		h.serveStats(w, r)
+		return
+	case "/sitemap.xml":
+		h.serveSitemap(w, r)
+		return
+	case "/robots.txt":
+		h.serveRobots(w, r)
+		return
+	case "/favicon.ico":
+		if h.conf.Favicon == "" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, h.conf.Favicon)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, wellKnownPrefix) {
+		h.serveWellKnown(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, badgePrefix) {
+		h.serveBadge(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, latestPrefix) {
+		h.serveLatest(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, staticPrefix) {
+		h.serveStatic(w, r)
+		return
+	}
+	goGet := r.URL.Query().Get("go-get") == "1"
+	if !goGet && r.URL.Path == "/" {
+		// The import paths listed depend on the client if some of
+		// them are protected
+		h.render(w, r, indexTemplate.Name(), h.index(r), h.conf.protected())
+		return
+	}
+	if !goGet && !isBrowser(r) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	pkgName := r.Host + r.URL.Path
+	info := requestInfoFrom(r.Context())
+	info.setPackage(pkgName)
+	mi, err := h.resolver.resolve(r.Context(), pkgName, h.conf.clientIP(r), false)
+	if err == nil {
+		// The packages not disclosed to the client are handled as
+		// unknown ones, unless the client may be authorized
+		p := &h.conf.Paths[mi.Index]
+		if !p.ACL.allowed(h.conf.clientIP(r)) {
+			err = ErrNoMatch
+		} else if !p.Auth.authorized(r) {
+			p.Auth.challenge(w, r)
+			return
+		}
+	}
+	if h.Metrics != nil && (err == nil || err == ErrNoMatch) {
+		h.Metrics.resolved(err == nil)
+	}
+	if err == ErrNoMatch {
+		slog.WarnContext(r.Context(), "no import path matches the package", "package", pkgName)
+		if h.OnMiss != nil {
+			h.OnMiss(w, r, pkgName)
+		} else {
+			page := notFoundPage{Host: r.Host, Package: pkgName}
+			h.renderStatus(w, r, notFoundTemplate.Name(), page, http.StatusNotFound, false)
+		}
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to execute template", "package", pkgName, "err", err)
+		http.NotFound(w, r)
+		return
+	}
+	info.setMatch(&mi)
+	p := &h.conf.Paths[mi.Index]
+	if h.OnMatch != nil && !h.OnMatch(w, r, pkgName, p) {
+		return
+	}
+	if h.Stats != nil {
+		h.Stats.Add(p.Prefix, client(r), time.Now())
+	}
+	if !goGet {
+		u, err := h.conf.redirectURL(&mi, pkgName)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to execute browse template", "package", pkgName, "err", err)
+			http.NotFound(w, r)
+			return
+		}
+		if u != "" {
+			http.Redirect(w, r, u, http.StatusFound)
+			return
+		}
+	}
+	var data interface{} = mi
+	name := mainTemplate.Name()
+	if !goGet {
+		page := landingPage{MetaImport: mi, Package: pkgName, Description: p.Description}
+		ttl := time.Duration(h.conf.ReadmeTTL)
+		if ttl <= 0 {
+			ttl = defaultReadmeTTL
+		}
+		// The forges are not asked about the repositories of the
+		// import paths matched by a regexp, anyone being able to make
+		// up as many such repositories as they want
+		if _, ok := forgeAPIs[p.Forge]; ok && mi.Source != nil && p.re == nil {
+			if page.Description == "" {
+				page.Description = description(p.Forge, mi.Source.Home, ttl)
+			}
+			if p.Readme {
+				page.Readme = readme(p.Forge, mi.Source.Home, ttl)
+			}
+		}
+		data = page
+		name = landingTemplate.Name()
+	}
+	h.render(w, r, name, data, p.protected())
+}
+
+// render writes the page rendered by the template name with data. The
+// page is tagged with a strong ETag and not sent again if it's the one
+// the client already has. If private is true, the page depends on the
+// client and must not be kept by the shared caches.
+func (h *Handler) render(w http.ResponseWriter, r *http.Request, name string, data interface{}, private bool) {
+	h.renderStatus(w, r, name, data, http.StatusOK, private)
+}
+
+// renderStatus is like render but replies with the status code
+// status.
+func (h *Handler) renderStatus(w http.ResponseWriter, r *http.Request, name string, data interface{}, status int, private bool) {
+	html := &strings.Builder{}
+	if err := h.conf.tmpl.ExecuteTemplate(html, name, data); err != nil {
+		slog.ErrorContext(r.Context(), "failed to execute template", "template", name, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if status == http.StatusOK {
+		if private {
+			w.Header().Set("Cache-Control", "private")
+			w.Header().Add("Vary", "Authorization")
+		} else if h.conf.CacheControl != "" {
+			w.Header().Set("Cache-Control", h.conf.CacheControl)
+		}
+		sum := sha256.Sum256([]byte(html.String()))
+		etag := `"` + hex.EncodeToString(sum[:]) + `"`
+		w.Header().Set("ETag", etag)
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	w.Write([]byte(html.String()))
+}
+
+// etagMatch reports whether the If-None-Match header value header
+// matches the strong ETag etag.
+func etagMatch(header string, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package metaimport
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of
+// the histogram of the durations of the requests. They are the
+// default ones of the Prometheus clients.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics holds the metrics of the requests served by the handlers,
+// exposed in the text format of Prometheus by its ServeHTTP method.
+// It's safe for concurrent use and can be shared by several handlers
+// so that the metrics survive configuration reloads.
+type Metrics struct {
+	mu       sync.Mutex
+	requests map[int]uint64
+	matches  uint64
+	misses   uint64
+	buckets  []uint64
+	sum      float64
+	count    uint64
+}
+
+// NewMetrics returns zeroed metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{requests: map[int]uint64{}, buckets: make([]uint64, len(latencyBuckets))}
+}
+
+// observe records a request which has been answered with the status
+// code status in d.
+func (m *Metrics) observe(status int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[status]++
+	for i, b := range latencyBuckets {
+		if d.Seconds() <= b {
+			m.buckets[i]++
+		}
+	}
+	m.sum += d.Seconds()
+	m.count++
+}
+
+// resolved records the result of the resolution of a package.
+func (m *Metrics) resolved(matched bool) {
+	m.mu.Lock()
+	if matched {
+		m.matches++
+	} else {
+		m.misses++
+	}
+	m.mu.Unlock()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b := &strings.Builder{}
+	m.mu.Lock()
+	codes := make([]int, 0, len(m.requests))
+	for code := range m.requests {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	fmt.Fprintln(b, "# HELP metaimport_requests_total Number of requests served, by status code.")
+	fmt.Fprintln(b, "# TYPE metaimport_requests_total counter")
+	for _, code := range codes {
+		fmt.Fprintf(b, "metaimport_requests_total{code=\"%d\"} %d\n", code, m.requests[code])
+	}
+	fmt.Fprintln(b, "# HELP metaimport_request_duration_seconds Duration of the requests.")
+	fmt.Fprintln(b, "# TYPE metaimport_request_duration_seconds histogram")
+	for i, le := range latencyBuckets {
+		fmt.Fprintf(b, "metaimport_request_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(le, 'g', -1, 64), m.buckets[i])
+	}
+	fmt.Fprintf(b, "metaimport_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.count)
+	fmt.Fprintf(b, "metaimport_request_duration_seconds_sum %s\n", strconv.FormatFloat(m.sum, 'g', -1, 64))
+	fmt.Fprintf(b, "metaimport_request_duration_seconds_count %d\n", m.count)
+	fmt.Fprintln(b, "# HELP metaimport_resolutions_total Number of packages resolved, by result.")
+	fmt.Fprintln(b, "# TYPE metaimport_resolutions_total counter")
+	fmt.Fprintf(b, "metaimport_resolutions_total{result=\"match\"} %d\n", m.matches)
+	fmt.Fprintf(b, "metaimport_resolutions_total{result=\"miss\"} %d\n", m.misses)
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(b.String()))
+}
+
+// statusRecorder records the status code and the size of the body of
+// the response written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// Unwrap returns the underlying response writer, for
+// http.ResponseController.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
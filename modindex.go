@@ -0,0 +1,160 @@
+package metaimport
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/semver"
+)
+
+// maxIndexLimit is the maximum number of versions returned by a
+// request to the module index, as for index.golang.org.
+const maxIndexLimit = 2000
+
+// indexVersion is a version of a module listed by the module index.
+type indexVersion struct {
+	Path      string
+	Version   string
+	Timestamp time.Time
+}
+
+// indexPath returns the path of the module index.
+func (c *ProxyConfig) indexPath() string {
+	return c.path() + "/index"
+}
+
+// moduleIndexCache holds the versions of the module index by import
+// path, listed at most once per fetch interval.
+type moduleIndexCache struct {
+	sync.Mutex
+	listed   time.Time
+	versions map[int][]indexVersion
+}
+
+// moduleIndex returns the versions of the modules of the import paths
+// hosted in git repositories, discovered from the tags of their
+// repository and sorted by time. A tag such as dir/v1.2.3 is a version
+// of the module in the directory dir of the repository. Only the import
+// paths disclosed to the client which sent r are listed.
+func (h *Handler) moduleIndex(r *http.Request) []indexVersion {
+	indexed := h.indexedVersions(r.Context())
+	var versions []indexVersion
+	for i := range h.conf.Paths {
+		if len(indexed[i]) > 0 && h.disclosed(i, r) {
+			versions = append(versions, indexed[i]...)
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].Timestamp.Before(versions[j].Timestamp)
+	})
+	return versions
+}
+
+// indexedVersions returns the versions of the module index by import
+// path, listed again if they have been for the fetch interval. The
+// repositories are mirrored by a single request at once, which is not
+// interrupted if its client goes away.
+func (h *Handler) indexedVersions(ctx context.Context) map[int][]indexVersion {
+	interval := time.Duration(h.conf.Proxy.FetchInterval)
+	if interval <= 0 {
+		interval = defaultFetchInterval
+	}
+	c := &h.modIndex
+	c.Lock()
+	defer c.Unlock()
+	if c.versions != nil && time.Since(c.listed) < interval {
+		return c.versions
+	}
+	ctx = context.WithoutCancel(ctx)
+	versions := map[int][]indexVersion{}
+	for i, p := range h.conf.Paths {
+		if p.re != nil || p.NbComponents != len(strings.Split(p.Prefix, "/")) {
+			continue
+		}
+		mi, err := h.resolver.resolve(ctx, p.Prefix, nil, true)
+		if err != nil || mi.Index != i || mi.VCS != "git" {
+			continue
+		}
+		m, err := getMirror(ctx, h.conf.Proxy.Cache, mi.Repo, interval)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to mirror", "repo", mi.Repo, "err", err)
+			continue
+		}
+		format := "%(refname:strip=2) %(committerdate:iso-strict) %(*committerdate:iso-strict)"
+		out, err := git(m.dir, "for-each-ref", "--format="+format, "refs/tags")
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to list the tags", "repo", mi.Repo, "err", err)
+			continue
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			// The date of the commit of an annotated tag is the
+			// last one
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, fields[len(fields)-1])
+			if err != nil {
+				continue
+			}
+			modPath, v := mi.Prefix, fields[0]
+			if j := strings.LastIndex(v, "/"); j >= 0 {
+				modPath, v = modPath+"/"+v[:j], v[j+1:]
+			}
+			if semver.Canonical(v) != v {
+				continue
+			}
+			if major := semver.Major(v); major != "v0" && major != "v1" {
+				modPath += "/" + major
+			}
+			versions[i] = append(versions[i], indexVersion{Path: modPath, Version: v, Timestamp: t.UTC()})
+		}
+	}
+	c.versions, c.listed = versions, time.Now()
+	return versions
+}
+
+// serveModuleIndex writes, as JSON lines, the versions of the module
+// index published since the time given by the since parameter of r,
+// at most limit of them.
+func (h *Handler) serveModuleIndex(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "bad since parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := maxIndexLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "bad limit parameter", http.StatusBadRequest)
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	e := json.NewEncoder(w)
+	for _, v := range h.moduleIndex(r) {
+		if limit == 0 {
+			break
+		}
+		if v.Timestamp.Before(since) {
+			continue
+		}
+		e.Encode(v)
+		limit--
+	}
+}
@@ -0,0 +1,72 @@
+package metaimport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestModuleIndexCached(t *testing.T) {
+	dir := t.TempDir()
+	repo := filepath.Join(dir, "repo")
+	run := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		cmd.Env = append(cmd.Environ(), "GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com", "GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %s: %s", args[0], err, out)
+		}
+	}
+	cmd := exec.Command("git", "init", "--quiet", repo)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git init: %s: %s", err, out)
+	}
+	run("commit", "--quiet", "--allow-empty", "-m", "initial")
+	run("tag", "v1.0.0")
+	conf, err := ParseConfig(strings.NewReader(`{
+  "proxy": {"cache": "`+filepath.Join(dir, "cache")+`", "fetch_interval": "1h"},
+  "paths": [
+    {
+      "prefix": "example.com/mod",
+      "vcs": "git",
+      "repo_template": "file://`+repo+`",
+      "acl": {"allow": ["10.0.0.0/8"]}
+    }
+  ]
+}`), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := func(remote string) string {
+		r := httptest.NewRequest(http.MethodGet, "/-/proxy/index", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /-/proxy/index: got status %d, want 200", w.Code)
+		}
+		return w.Body.String()
+	}
+	if got := index("10.0.0.1:1234"); !strings.Contains(got, `"Version":"v1.0.0"`) {
+		t.Errorf("index = %q, want v1.0.0", got)
+	}
+	// The index is not listed again from the mirrors before the fetch
+	// interval
+	if err := os.RemoveAll(filepath.Join(dir, "cache")); err != nil {
+		t.Fatal(err)
+	}
+	if got := index("10.0.0.1:1234"); !strings.Contains(got, `"Version":"v1.0.0"`) {
+		t.Errorf("index = %q, listed again before the fetch interval", got)
+	}
+	if got := index("192.0.2.1:1234"); got != "" {
+		t.Errorf("index for an undisclosed client = %q, want none", got)
+	}
+}
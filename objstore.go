@@ -0,0 +1,192 @@
+package metaimport
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// newS3Request returns a request fetching the object referred to by
+// an s3://BUCKET/KEY URL. The region and the credentials are taken
+// from the standard AWS environment variables and the request is
+// signed only if credentials are available. AWS_ENDPOINT_URL_S3 (or
+// AWS_ENDPOINT_URL) can be used to target an S3 compatible service, in
+// which case path-style addressing is used.
+func newS3Request(u *url.URL) (*http.Request, error) {
+	region := firstEnv("AWS_REGION", "AWS_DEFAULT_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	target := &url.URL{Scheme: "https"}
+	if endpoint := firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"); endpoint != "" {
+		e, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		target.Scheme = e.Scheme
+		target.Host = e.Host
+		target.Path = "/" + u.Host + "/" + key
+	} else {
+		target.Host = u.Host + ".s3." + region + ".amazonaws.com"
+		target.Path = "/" + key
+	}
+	target.RawPath = awsEscapePath(target.Path)
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey != "" && secretKey != "" {
+		signV4(req, region, "s3", accessKey, secretKey, os.Getenv("AWS_SESSION_TOKEN"), time.Now())
+	}
+	return req, nil
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// awsEscapePath escapes each segment of p as required by the AWS
+// signature version 4.
+func awsEscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// signV4 signs the body-less request req using the AWS signature
+// version 4.
+func signV4(req *http.Request, region, service, accessKey, secretKey, token string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	headers := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:UNSIGNED-PAYLOAD\n" +
+		"x-amz-date:" + amzDate + "\n"
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+		signed = append(signed, "x-amz-security-token")
+		headers += "x-amz-security-token:" + token + "\n"
+	}
+	signedHeaders := strings.Join(signed, ";")
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers,
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := []byte("AWS4" + secretKey)
+	for _, s := range []string{day, region, service, "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(s))
+		key = mac.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, hex.EncodeToString(key),
+	))
+}
+
+// newGCSRequest returns a request fetching the object referred to by
+// a gs://BUCKET/OBJECT URL. The access token is taken from the
+// GOOGLE_OAUTH_ACCESS_TOKEN environment variable or, when running on
+// Google Cloud, from the metadata server. Without a token, the object
+// must be publicly readable.
+func newGCSRequest(u *url.URL) (*http.Request, error) {
+	target := &url.URL{
+		Scheme: "https",
+		Host:   "storage.googleapis.com",
+		Path:   "/" + u.Host + u.Path,
+	}
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+	if token == "" {
+		token = gceToken()
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+var gceMetadata struct {
+	sync.Mutex
+	unavailable bool
+	token       string
+	expiry      time.Time
+}
+
+// gceToken returns an access token for the default service account
+// from the Google Compute Engine metadata server, or an empty string
+// if the metadata server can't be reached.
+func gceToken() string {
+	gceMetadata.Lock()
+	defer gceMetadata.Unlock()
+	if gceMetadata.unavailable {
+		return ""
+	}
+	if gceMetadata.token != "" && time.Now().Before(gceMetadata.expiry) {
+		return gceMetadata.token
+	}
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return ""
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		gceMetadata.unavailable = true
+		return ""
+	}
+	defer resp.Body.Close()
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&t) != nil {
+		return ""
+	}
+	gceMetadata.token = t.AccessToken
+	// Renew the token a bit before it expires
+	gceMetadata.expiry = time.Now().Add(time.Duration(t.ExpiresIn)*time.Second - time.Minute)
+	return gceMetadata.token
+}
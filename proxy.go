@@ -0,0 +1,443 @@
+package metaimport
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/mod/zip"
+)
+
+const (
+	defaultProxyPath     = "/-/proxy"
+	defaultFetchInterval = time.Minute
+	// mirrorTimeout is the time after which the clone or the fetch of
+	// a repository is given up
+	mirrorTimeout = 5 * time.Minute
+)
+
+// ProxyConfig holds the settings of the built-in module proxy, which
+// serves the modules of the import paths hosted in git repositories
+// using the GOPROXY protocol.
+type ProxyConfig struct {
+	Path            string            `doc:"Path under which the module proxy is served, GOPROXY being the URL of the host followed by this path, and the module index listing the tagged versions at index below it" default:"/-/proxy"`
+	Cache           string            `doc:"Directory holding the mirrors of the repositories, required unless upstream is set"`
+	FetchInterval   Duration          `json:"fetch_interval" doc:"Minimum interval between two fetches of a repository" default:"1m"`
+	Upstream        string            `doc:"URL of the module proxy the requests for the modules of the import paths are forwarded to, instead of serving them from the repositories"`
+	UpstreamHeaders map[string]string `json:"upstream_headers" doc:"Headers added to the requests forwarded to the upstream proxy"`
+}
+
+// path returns the path under which the module proxy is served.
+func (c *ProxyConfig) path() string {
+	if c.Path == "" {
+		return defaultProxyPath
+	}
+	return strings.TrimSuffix(c.Path, "/")
+}
+
+// match splits the path urlPath of a request to the module proxy into
+// the escaped module path and the requested file, @latest or the file
+// following /@v/. It reports whether urlPath is such a path.
+func (c *ProxyConfig) match(urlPath string) (escaped, op string, ok bool) {
+	rest, ok := strings.CutPrefix(urlPath, c.path()+"/")
+	if !ok {
+		return "", "", false
+	}
+	if escaped, ok := strings.CutSuffix(rest, "/@latest"); ok {
+		return escaped, "@latest", true
+	}
+	if i := strings.LastIndex(rest, "/@v/"); i >= 0 {
+		return rest[:i], rest[i+len("/@v/"):], true
+	}
+	return "", "", false
+}
+
+// forward forwards the request r to the upstream module proxy, the
+// path of the module proxy being replaced by the one of the upstream
+// proxy and the ID of r being passed on.
+func (c *ProxyConfig) forward(w http.ResponseWriter, r *http.Request) {
+	target, err := url.Parse(c.Upstream)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "bad upstream proxy", "upstream", c.Upstream, "err", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Path = strings.TrimPrefix(pr.In.URL.Path, c.path())
+			pr.Out.URL.RawPath = ""
+			pr.SetURL(target)
+			if id := RequestID(pr.In.Context()); id != "" {
+				pr.Out.Header.Set(requestIDHeader, id)
+			}
+			for name, value := range c.UpstreamHeaders {
+				pr.Out.Header.Set(name, value)
+			}
+		},
+	}
+	rp.ServeHTTP(w, r)
+}
+
+// mirror is the local mirror of a repository, cloned in the .git
+// subdirectory of dir.
+type mirror struct {
+	sync.Mutex
+	dir     string
+	fetched time.Time
+}
+
+// mirrors holds the mirrors of the repositories by directory. It's
+// shared by all the handlers so that the repositories are not fetched
+// again when the configuration is reloaded.
+var mirrors struct {
+	sync.Mutex
+	entries map[string]*mirror
+}
+
+// git runs git with args in the directory dir and returns its output.
+func git(dir string, args ...string) ([]byte, error) {
+	return gitContext(context.Background(), dir, args...)
+}
+
+// gitContext is like git but the command is killed when ctx is done.
+func gitContext(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
+
+// getMirror returns the mirror of the repository repo kept in the
+// directory cache, cloning it if it doesn't exist yet and fetching it
+// if it has not been fetched for interval. ctx is the context of the
+// request needing it.
+func getMirror(ctx context.Context, cache, repo string, interval time.Duration) (*mirror, error) {
+	sum := sha256.Sum256([]byte(repo))
+	dir := filepath.Join(cache, hex.EncodeToString(sum[:]))
+	mirrors.Lock()
+	if mirrors.entries == nil {
+		mirrors.entries = map[string]*mirror{}
+	}
+	m, ok := mirrors.entries[dir]
+	if !ok {
+		m = &mirror{dir: dir}
+		mirrors.entries[dir] = m
+	}
+	mirrors.Unlock()
+	m.Lock()
+	defer m.Unlock()
+	if time.Since(m.fetched) < interval {
+		return m, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, mirrorTimeout)
+	defer cancel()
+	gitDir := filepath.Join(dir, ".git")
+	if _, err := os.Stat(gitDir); err != nil {
+		if err := cloneMirror(ctx, dir, repo); err != nil {
+			// Nothing is kept for the repositories which can't be
+			// cloned, e.g. the ones of unknown modules
+			os.RemoveAll(dir)
+			mirrors.Lock()
+			delete(mirrors.entries, dir)
+			mirrors.Unlock()
+			return nil, err
+		}
+	} else if _, err := gitContext(ctx, gitDir, "fetch", "--prune", "--quiet"); err != nil {
+		slog.WarnContext(ctx, "failed to fetch, serving the mirror as is", "repo", repo, "err", err)
+	}
+	m.fetched = time.Now()
+	return m, nil
+}
+
+// cloneMirror clones the repository repo in the .git subdirectory of
+// dir, which is created if needed.
+func cloneMirror(ctx context.Context, dir, repo string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(dir, "clone")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	// The repository is given after -- not to be taken as an option
+	if _, err := gitContext(ctx, dir, "clone", "--mirror", "--quiet", "--", repo, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, ".git"))
+}
+
+// proxyModule is a module served by the module proxy.
+type proxyModule struct {
+	path   string
+	mirror *mirror
+	// major is the major version suffix of the path, e.g. v2
+	major string
+	// tagPrefix is the prefix of the tags of the versions
+	tagPrefix string
+	// dirs are the directories of the repository which may hold the
+	// module, the first one holding a go.mod file is used
+	dirs []string
+}
+
+// proxyInfo is the JSON object describing a version of a module.
+type proxyInfo struct {
+	Version string
+	Time    time.Time
+}
+
+// proxyModule returns the module whose path is modPath, which must
+// belong to an import path hosted in a git repository.
+func (h *Handler) proxyModule(ctx context.Context, modPath string) (*proxyModule, error) {
+	mi, err := h.resolver.resolve(ctx, modPath, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	if mi.VCS != "git" {
+		return nil, fmt.Errorf("%s is not hosted in a git repository", modPath)
+	}
+	prefix, major, ok := module.SplitPathVersion(modPath)
+	if !ok {
+		return nil, fmt.Errorf("bad module path %s", modPath)
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(modPath, mi.Prefix), "/")
+	base := ""
+	if len(prefix) > len(mi.Prefix) {
+		base = strings.TrimPrefix(prefix[len(mi.Prefix):], "/")
+	}
+	m := &proxyModule{path: modPath, major: strings.TrimPrefix(major, "/"), dirs: []string{rel}}
+	if base != rel {
+		m.dirs = append(m.dirs, base)
+	}
+	if base != "" {
+		m.tagPrefix = base + "/"
+	}
+	interval := time.Duration(h.conf.Proxy.FetchInterval)
+	if interval <= 0 {
+		interval = defaultFetchInterval
+	}
+	m.mirror, err = getMirror(ctx, h.conf.Proxy.Cache, mi.Repo, interval)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// versions returns the tagged versions of m, sorted.
+func (m *proxyModule) versions() ([]string, error) {
+	out, err := git(m.mirror.dir, "tag", "--list", m.tagPrefix+"v*")
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, tag := range strings.Fields(string(out)) {
+		v := strings.TrimPrefix(tag, m.tagPrefix)
+		if semver.Canonical(v) != v {
+			continue
+		}
+		if major := semver.Major(v); m.major != "" && major != m.major || m.major == "" && major != "v0" && major != "v1" {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	semver.Sort(versions)
+	return versions, nil
+}
+
+// commit returns the commit of the version v of m and its time.
+func (m *proxyModule) commit(v string) (string, time.Time, error) {
+	rev := "refs/tags/" + m.tagPrefix + v
+	if module.IsPseudoVersion(v) {
+		var err error
+		if rev, err = module.PseudoVersionRev(v); err != nil {
+			return "", time.Time{}, err
+		}
+	} else if semver.Canonical(v) != v {
+		return "", time.Time{}, fmt.Errorf("bad version %s", v)
+	}
+	out, err := git(m.mirror.dir, "log", "-1", "--format=%H %cI", rev+"^{commit}", "--")
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("unknown version %s of %s", v, m.path)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return "", time.Time{}, fmt.Errorf("unexpected git output %q", out)
+	}
+	t, err := time.Parse(time.RFC3339, fields[1])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return fields[0], t.UTC(), nil
+}
+
+// info returns the description of the version v of m.
+func (m *proxyModule) info(v string) (*proxyInfo, error) {
+	_, t, err := m.commit(v)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyInfo{Version: v, Time: t}, nil
+}
+
+// latest returns the description of the latest version of m: the
+// highest release, the highest pre-release if there is none or a
+// pseudo-version of the default branch if there is no tagged version.
+func (m *proxyModule) latest() (*proxyInfo, error) {
+	versions, err := m.versions()
+	if err != nil {
+		return nil, err
+	}
+	if v := latestVersion(versions); v != "" {
+		return m.info(v)
+	}
+	out, err := git(m.mirror.dir, "log", "-1", "--format=%H %cI", "HEAD", "--")
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("unexpected git output %q", out)
+	}
+	t, err := time.Parse(time.RFC3339, fields[1])
+	if err != nil {
+		return nil, err
+	}
+	t = t.UTC()
+	return &proxyInfo{Version: module.PseudoVersion(m.major, "", t, fields[0][:12]), Time: t}, nil
+}
+
+// modFile returns the go.mod file of m at commit and the directory of
+// the repository holding the module. A go.mod file is synthesized for
+// the modules without one, unless they have a major version suffix.
+func (m *proxyModule) modFile(commit string) ([]byte, string, error) {
+	for _, dir := range m.dirs {
+		if data, err := git(m.mirror.dir, "show", commit+":"+path.Join(dir, "go.mod")); err == nil {
+			return data, dir, nil
+		}
+	}
+	if m.major != "" {
+		return nil, "", fmt.Errorf("no go.mod file for %s", m.path)
+	}
+	return []byte(fmt.Sprintf("module %s\n", m.path)), m.dirs[0], nil
+}
+
+// serveProxy serves the request r to the module proxy for the file op
+// of the module whose escaped path is escaped.
+func (h *Handler) serveProxy(w http.ResponseWriter, r *http.Request, escaped, op string) {
+	modPath, err := module.UnescapePath(escaped)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	// Only the modules of the import paths are served, the upstream
+	// proxy and its credentials are not relayed for the other ones
+	mi, err := h.resolver.resolve(r.Context(), modPath, nil, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	p := &h.conf.Paths[mi.Index]
+	if !p.ACL.allowed(h.conf.clientIP(r)) {
+		http.Error(w, ErrNoMatch.Error(), http.StatusNotFound)
+		return
+	}
+	if !p.Auth.authorized(r) {
+		p.Auth.challenge(w, r)
+		return
+	}
+	// The modules are forwarded once the client is known to be allowed
+	if h.conf.Proxy.Upstream != "" {
+		h.conf.Proxy.forward(w, r)
+		return
+	}
+	data, contentType, err := h.proxyFile(r.Context(), modPath, op)
+	if err != nil {
+		slog.WarnContext(r.Context(), "failed to serve module file", "module", modPath, "file", op, "err", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// proxyFile returns the content of the file op of the module modPath
+// and its type, op being @latest, list or a version followed by .info,
+// .mod or .zip.
+func (h *Handler) proxyFile(ctx context.Context, modPath, op string) ([]byte, string, error) {
+	m, err := h.proxyModule(ctx, modPath)
+	if err != nil {
+		return nil, "", err
+	}
+	switch op {
+	case "@latest":
+		info, err := m.latest()
+		if err != nil {
+			return nil, "", err
+		}
+		data, err := json.Marshal(info)
+		return data, "application/json", err
+	case "list":
+		versions, err := m.versions()
+		if err != nil {
+			return nil, "", err
+		}
+		list := ""
+		for _, v := range versions {
+			list += v + "\n"
+		}
+		return []byte(list), "text/plain; charset=utf-8", nil
+	}
+	ext := path.Ext(op)
+	v, err := module.UnescapeVersion(strings.TrimSuffix(op, ext))
+	if err != nil {
+		return nil, "", err
+	}
+	switch ext {
+	case ".info":
+		info, err := m.info(v)
+		if err != nil {
+			return nil, "", err
+		}
+		data, err := json.Marshal(info)
+		return data, "application/json", err
+	case ".mod", ".zip":
+		commit, _, err := m.commit(v)
+		if err != nil {
+			return nil, "", err
+		}
+		data, dir, err := m.modFile(commit)
+		if err != nil || ext == ".mod" {
+			return data, "text/plain; charset=utf-8", err
+		}
+		buf := &bytes.Buffer{}
+		mv := module.Version{Path: m.path, Version: v}
+		if err := zip.CreateFromVCS(buf, mv, m.mirror.dir, commit, dir); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "application/zip", nil
+	}
+	return nil, "", fmt.Errorf("unknown file %s", op)
+}
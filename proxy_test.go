@@ -0,0 +1,97 @@
+package metaimport
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeProxyUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("v1.0.0\n"))
+	}))
+	defer upstream.Close()
+	conf, err := ParseConfig(strings.NewReader(`{
+  "proxy": {"upstream": "`+upstream.URL+`"},
+  "paths": [
+    {
+      "prefix": "example.com/public",
+      "vcs": "git",
+      "repo_template": "https://git.example.com/public.git"
+    },
+    {
+      "prefix": "example.com/internal",
+      "vcs": "git",
+      "repo_template": "https://git.example.com/internal.git",
+      "acl": {"allow": ["10.0.0.0/8"]}
+    },
+    {
+      "prefix": "example.com/private",
+      "vcs": "git",
+      "repo_template": "https://git.example.com/private.git",
+      "auth": {"users": {"alice": "secret"}}
+    }
+  ]
+}`), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path   string
+		remote string
+		user   string
+		want   int
+	}{
+		{"/-/proxy/example.com/public/@v/list", "192.0.2.1:1234", "", http.StatusOK},
+		{"/-/proxy/example.org/other/@v/list", "192.0.2.1:1234", "", http.StatusNotFound},
+		{"/-/proxy/example.com/internal/@v/list", "192.0.2.1:1234", "", http.StatusNotFound},
+		{"/-/proxy/example.com/internal/@v/list", "10.0.0.1:1234", "", http.StatusOK},
+		{"/-/proxy/example.com/private/@v/list", "192.0.2.1:1234", "", http.StatusUnauthorized},
+		{"/-/proxy/example.com/private/@v/list", "192.0.2.1:1234", "alice", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		r.RemoteAddr = test.remote
+		if test.user != "" {
+			r.SetBasicAuth(test.user, "secret")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("GET %s from %s as %q: got status %d, want %d", test.path, test.remote, test.user, w.Code, test.want)
+		}
+	}
+}
+
+func TestGetMirrorCloneFailure(t *testing.T) {
+	cache := t.TempDir()
+	repo := "file://" + filepath.Join(cache, "missing")
+	if _, err := getMirror(context.Background(), cache, repo, time.Minute); err == nil {
+		t.Fatal("getMirror of a missing repository succeeded")
+	}
+	entries, err := os.ReadDir(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("cache holds %d entries after a failed clone, want none", len(entries))
+	}
+	sum := sha256.Sum256([]byte(repo))
+	mirrors.Lock()
+	_, ok := mirrors.entries[filepath.Join(cache, hex.EncodeToString(sum[:]))]
+	mirrors.Unlock()
+	if ok {
+		t.Error("mirror kept after a failed clone")
+	}
+}
@@ -0,0 +1,127 @@
+package metaimport
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sweepInterval is the interval between two removals of the buckets of
+// the clients which have not sent requests for a while.
+const sweepInterval = time.Minute
+
+// RateLimitConfig holds the settings of the rate limiting of the
+// requests, the ones over the limits being answered with a 429 error.
+type RateLimitConfig struct {
+	Rate        float64 `doc:"Number of requests per second allowed from a client, not limited when zero" schema:"minimum=0"`
+	Burst       int     `doc:"Number of requests a client can send at once, defaults to the rate rounded up" schema:"minimum=0"`
+	GlobalRate  float64 `json:"global_rate" doc:"Number of requests per second allowed from all the clients together, not limited when zero" schema:"minimum=0"`
+	GlobalBurst int     `json:"global_burst" doc:"Number of requests the clients can send at once, defaults to the global rate rounded up" schema:"minimum=0"`
+}
+
+// bucket is a token bucket, refilled at rate tokens per second up to
+// burst tokens.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newBucket returns a full bucket, nil if rate is zero.
+func newBucket(rate float64, burst int) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := &bucket{rate: rate, burst: float64(burst)}
+	if burst <= 0 {
+		b.burst = math.Ceil(rate)
+	}
+	b.tokens = b.burst
+	return b
+}
+
+// refill refills b with the tokens earned since the last refill, at now.
+func (b *bucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+// wait returns the time to wait before a token is available.
+func (b *bucket) wait() time.Duration {
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// rateLimiter limits the rate of the requests of each client and of all
+// of them.
+type rateLimiter struct {
+	conf    RateLimitConfig
+	mu      sync.Mutex
+	global  *bucket
+	clients map[string]*bucket
+	swept   time.Time
+}
+
+// newRateLimiter returns a rate limiter configured by conf.
+func newRateLimiter(conf *RateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		conf:    *conf,
+		global:  newBucket(conf.GlobalRate, conf.GlobalBurst),
+		clients: map[string]*bucket{},
+	}
+}
+
+// allow reports whether a request of the client whose address is ip,
+// received at now, is allowed. If it's not, the time to wait before
+// retrying is returned.
+func (l *rateLimiter) allow(ip net.IP, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) >= sweepInterval {
+		for k, b := range l.clients {
+			if b.refill(now); b.tokens >= b.burst {
+				delete(l.clients, k)
+			}
+		}
+		l.swept = now
+	}
+	var buckets []*bucket
+	if l.conf.Rate > 0 && ip != nil {
+		b := l.clients[ip.String()]
+		if b == nil {
+			b = newBucket(l.conf.Rate, l.conf.Burst)
+			l.clients[ip.String()] = b
+		}
+		buckets = append(buckets, b)
+	}
+	if l.global != nil {
+		buckets = append(buckets, l.global)
+	}
+	for _, b := range buckets {
+		if b.refill(now); b.tokens < 1 {
+			return false, b.wait()
+		}
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// limit returns a handler answering the requests over the limits of l
+// with a 429 error and passing the others to next.
+func (h *Handler) limit(l *rateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := l.allow(h.conf.clientIP(r), time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
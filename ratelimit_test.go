@@ -0,0 +1,89 @@
+package metaimport
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(&RateLimitConfig{Rate: 2, Burst: 3})
+	alice, bob := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	steps := []struct {
+		// after is the time elapsed since the previous request
+		after time.Duration
+		ip    net.IP
+		want  bool
+		wait  time.Duration
+	}{
+		// The burst is allowed at once
+		{0, alice, true, 0},
+		{0, alice, true, 0},
+		{0, alice, true, 0},
+		{0, alice, false, 500 * time.Millisecond},
+		// The buckets are per client
+		{0, bob, true, 0},
+		// A token is earned every 500ms
+		{250 * time.Millisecond, alice, false, 250 * time.Millisecond},
+		{250 * time.Millisecond, alice, true, 0},
+		{0, alice, false, 500 * time.Millisecond},
+		// The bucket is refilled up to the burst only
+		{10 * time.Second, alice, true, 0},
+		{0, alice, true, 0},
+		{0, alice, true, 0},
+		{0, alice, false, 500 * time.Millisecond},
+	}
+	for i, step := range steps {
+		now = now.Add(step.after)
+		ok, wait := l.allow(step.ip, now)
+		if ok != step.want || wait != step.wait {
+			t.Errorf("step %d: allow(%s) = %v, %s, want %v, %s", i, step.ip, ok, wait, step.want, step.wait)
+		}
+	}
+}
+
+func TestRateLimiterGlobal(t *testing.T) {
+	l := newRateLimiter(&RateLimitConfig{Rate: 10, GlobalRate: 1})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if ok, _ := l.allow(net.ParseIP("192.0.2.1"), now); !ok {
+		t.Error("first request denied")
+	}
+	// The global burst defaults to the global rate rounded up
+	if ok, wait := l.allow(net.ParseIP("192.0.2.2"), now); ok || wait != time.Second {
+		t.Errorf("allow over the global rate = %v, %s, want false, 1s", ok, wait)
+	}
+	// The clients without address are only limited globally
+	if ok, _ := l.allow(nil, now.Add(time.Second)); !ok {
+		t.Error("request without address denied")
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	l := newRateLimiter(&RateLimitConfig{Rate: 0.1, Burst: 10})
+	alice, bob := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.allow(alice, now)
+	for i := 0; i < 10; i++ {
+		l.allow(bob, now)
+	}
+	if len(l.clients) != 2 {
+		t.Fatalf("%d buckets, want 2", len(l.clients))
+	}
+	// After a sweep interval, the bucket of alice is full again and
+	// removed while the one of bob is still refilling
+	now = now.Add(sweepInterval)
+	l.allow(nil, now)
+	if _, ok := l.clients[alice.String()]; ok {
+		t.Error("full bucket kept")
+	}
+	if _, ok := l.clients[bob.String()]; !ok {
+		t.Error("refilling bucket removed")
+	}
+	// The bucket of an evicted client starts full
+	for i := 0; i < 10; i++ {
+		if ok, _ := l.allow(alice, now); !ok {
+			t.Fatalf("request %d of an evicted client denied", i)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package metaimport
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultPollInterval is the interval between two fetches of a remote
+// configuration when watch_interval is not set.
+const defaultPollInterval = time.Minute
+
+var errNotModified = errors.New("conf: not modified")
+
+var remoteClient = &http.Client{Timeout: 30 * time.Second}
+
+// isURL reports whether the configuration name refers to a remote
+// configuration.
+func isURL(name string) bool {
+	for _, scheme := range []string{"http://", "https://", "s3://", "gs://"} {
+		if strings.HasPrefix(name, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// newConfigRequest returns the request used to fetch the remote
+// configuration u.
+func newConfigRequest(u *url.URL) (*http.Request, error) {
+	switch u.Scheme {
+	case "s3":
+		return newS3Request(u)
+	case "gs":
+		return newGCSRequest(u)
+	default:
+		return http.NewRequest(http.MethodGet, u.String(), nil)
+	}
+}
+
+// remoteConfigFormat returns the format of a remote configuration,
+// based on the extension of its path or, if the extension is unknown,
+// on its content type.
+func remoteConfigFormat(u *url.URL, contentType string) string {
+	if isConfigFile(u.Path) {
+		return configFormat(u.Path)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.Contains(mediaType, "yaml"):
+		return "yaml"
+	case strings.Contains(mediaType, "toml"):
+		return "toml"
+	case strings.Contains(mediaType, "hcl"):
+		return "hcl"
+	default:
+		return "json"
+	}
+}
+
+// fetchConfig fetches and parses the remote configuration rawURL. If
+// etag is not empty and the configuration has not been modified since
+// it was retrieved, errNotModified is returned.
+func fetchConfig(rawURL string, etag string) (*Config, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	req, err := newConfigRequest(u)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, errNotModified
+	default:
+		return nil, fmt.Errorf("conf: failed to fetch %q: %s", u.Redacted(), resp.Status)
+	}
+	conf, err := parseConfig(resp.Body, remoteConfigFormat(u, resp.Header.Get("Content-Type")), false)
+	if err != nil {
+		return nil, err
+	}
+	conf.etag = resp.Header.Get("ETag")
+	return conf, nil
+}
+
+// pollConfig fetches the remote configuration rawURL, whose current
+// version is conf, every interval and calls fn with the new version
+// when it has been modified.
+func pollConfig(rawURL string, interval time.Duration, conf *Config, fn func(*Config)) {
+	for range time.Tick(interval) {
+		c, err := fetchConfig(rawURL, conf.etag)
+		if err == errNotModified {
+			continue
+		}
+		if err == nil {
+			err = c.prepare()
+		}
+		if err != nil {
+			slog.Error("failed to reload configuration", "name", rawURL, "err", err)
+			continue
+		}
+		fn(c)
+		conf = c
+	}
+}
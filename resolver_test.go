@@ -0,0 +1,312 @@
+package metaimport
+
+import (
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfig = `{
+  "paths": [
+    {
+      "prefix": "example.com",
+      "vcs": "git",
+      "repo_template": "https://github.com/example/{{ index . 1 }}",
+      "nb_components": 2
+    },
+    {
+      "prefix": "example.com/tools",
+      "vcs": "git",
+      "repo_template": "https://git.example.com/tools.git"
+    },
+    {
+      "prefix": "example.com/exp/",
+      "vcs": "hg",
+      "repo_template": "https://hg.example.com/{{ join . }}",
+      "nb_components": 3
+    },
+    {
+      "prefix": "example.org/mod",
+      "vcs": "mod",
+      "repo_template": "https://proxy.example.org"
+    },
+    {
+      "prefix": "example.org/src",
+      "vcs": "git",
+      "repo_template": "https://github.com/example/src",
+      "source": {
+        "home_template": "https://github.com/example/src",
+        "directory_template": "https://github.com/example/src/tree/main{/dir}"
+      }
+    },
+    {
+      "prefix": "example.org/gh",
+      "vcs": "git",
+      "repo_template": "https://github.com/example/gh.git",
+      "forge": "github"
+    },
+    {
+      "prefix": "example.org/gitea",
+      "vcs": "git",
+      "repo_template": "https://gitea.example.org/example/gitea.git",
+      "forge": "gitea",
+      "branch": "dev"
+    },
+    {
+      "prefix": "example.org/private/",
+      "vcs": "git",
+      "repo_template": "https://git.example.org/{{ index . 2 }}.git",
+      "nb_components": 3,
+      "mode": "mod",
+      "proxy_template": "https://proxy.example.org/private",
+      "vcs_networks": ["10.0.0.0/8"]
+    },
+    {
+      "regexp": "example\\.net/([a-z]+)-([a-z]+)",
+      "vcs": "git",
+      "repo_template": "https://gitlab.example.net/{{ index . 1 }}/{{ index . 2 }}.git",
+      "redirect": "repo",
+      "browse_template": "https://gitlab.example.net/{{ index . 1 }}"
+    }
+  ]
+}`
+
+func TestResolve(t *testing.T) {
+	conf, err := ParseConfig(strings.NewReader(testConfig), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewResolver(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		pkg  string
+		want MetaImport
+		err  error
+	}{
+		{
+			pkg:  "example.com/foo",
+			want: MetaImport{Prefix: "example.com/foo", VCS: "git", Repo: "https://github.com/example/foo", Index: 0},
+		},
+		{
+			pkg:  "example.com/foo/bar/baz",
+			want: MetaImport{Prefix: "example.com/foo", VCS: "git", Repo: "https://github.com/example/foo", Index: 0},
+		},
+		{
+			pkg:  "example.com/tools",
+			want: MetaImport{Prefix: "example.com/tools", VCS: "git", Repo: "https://git.example.com/tools.git", Index: 1},
+		},
+		{
+			pkg:  "example.com/tools/cmd/lint",
+			want: MetaImport{Prefix: "example.com/tools", VCS: "git", Repo: "https://git.example.com/tools.git", Index: 1},
+		},
+		{
+			// Matched by prefix, not on a component boundary
+			pkg:  "example.com/toolsx",
+			want: MetaImport{Prefix: "example.com/toolsx", VCS: "git", Repo: "https://git.example.com/tools.git", Index: 1},
+		},
+		{
+			pkg:  "example.com/exp/x/y",
+			want: MetaImport{Prefix: "example.com/exp/x", VCS: "hg", Repo: "https://hg.example.com/example.com/exp/x/y", Index: 2},
+		},
+		{
+			// Not below the prefix of path 2
+			pkg:  "example.com/exp",
+			want: MetaImport{Prefix: "example.com/exp", VCS: "git", Repo: "https://github.com/example/exp", Index: 0},
+		},
+		{
+			pkg:  "example.org/mod",
+			want: MetaImport{Prefix: "example.org/mod", VCS: "mod", Repo: "https://proxy.example.org", Index: 3},
+		},
+		{
+			pkg: "example.org/src/pkg",
+			want: MetaImport{
+				Prefix: "example.org/src",
+				VCS:    "git",
+				Repo:   "https://github.com/example/src",
+				Source: &Source{
+					Home:      "https://github.com/example/src",
+					Directory: "https://github.com/example/src/tree/main{/dir}",
+					File:      "_",
+				},
+				Index: 4,
+			},
+		},
+		{
+			pkg: "example.org/gh",
+			want: MetaImport{
+				Prefix: "example.org/gh",
+				VCS:    "git",
+				Repo:   "https://github.com/example/gh.git",
+				Source: &Source{
+					Home:      "https://github.com/example/gh",
+					Directory: "https://github.com/example/gh/tree/HEAD{/dir}",
+					File:      "https://github.com/example/gh/blob/HEAD{/dir}/{file}#L{line}",
+				},
+				Index: 5,
+			},
+		},
+		{
+			pkg: "example.org/gitea/x",
+			want: MetaImport{
+				Prefix: "example.org/gitea",
+				VCS:    "git",
+				Repo:   "https://gitea.example.org/example/gitea.git",
+				Source: &Source{
+					Home:      "https://gitea.example.org/example/gitea",
+					Directory: "https://gitea.example.org/example/gitea/src/branch/dev{/dir}",
+					File:      "https://gitea.example.org/example/gitea/src/branch/dev{/dir}/{file}#L{line}",
+				},
+				Index: 6,
+			},
+		},
+		{
+			pkg:  "example.org/private/lib/x",
+			want: MetaImport{Prefix: "example.org/private/lib", VCS: "mod", Repo: "https://proxy.example.org/private", Index: 7},
+		},
+		{
+			pkg:  "example.net/team-svc/pkg",
+			want: MetaImport{Prefix: "example.net/team-svc", VCS: "git", Repo: "https://gitlab.example.net/team/svc.git", Index: 8},
+		},
+		{
+			// The regexp must match a whole import prefix
+			pkg: "example.net/team-svc2",
+			err: ErrNoMatch,
+		},
+		{
+			// Too short for path 0
+			pkg: "example.com",
+			err: ErrNoMatch,
+		},
+		{
+			pkg: "example.net/foo",
+			err: ErrNoMatch,
+		},
+		{
+			pkg: "",
+			err: ErrNoMatch,
+		},
+	}
+	for _, test := range tests {
+		got, err := r.Resolve(test.pkg)
+		if err != test.err {
+			t.Errorf("Resolve(%q): got error %v, want %v", test.pkg, err, test.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Resolve(%q) = %+v, want %+v", test.pkg, got, test.want)
+		}
+	}
+}
+
+func TestRedirectURL(t *testing.T) {
+	conf, err := ParseConfig(strings.NewReader(testConfig), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewResolver(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := "example.net/team-svc/pkg"
+	mi, err := r.Resolve(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := conf.redirectURL(&mi, pkg)
+	if want := "https://gitlab.example.net/team"; err != nil || got != want {
+		t.Errorf("redirectURL(%q) = %q, %v, want %q", pkg, got, err, want)
+	}
+}
+
+func TestResolveFor(t *testing.T) {
+	conf, err := ParseConfig(strings.NewReader(testConfig), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewResolver(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want MetaImport
+	}{
+		{
+			ip:   "10.1.2.3",
+			want: MetaImport{Prefix: "example.org/private/lib", VCS: "git", Repo: "https://git.example.org/lib.git", Index: 7},
+		},
+		{
+			ip:   "192.0.2.1",
+			want: MetaImport{Prefix: "example.org/private/lib", VCS: "mod", Repo: "https://proxy.example.org/private", Index: 7},
+		},
+	}
+	for _, test := range tests {
+		got, err := r.ResolveFor("example.org/private/lib", net.ParseIP(test.ip))
+		if err != nil {
+			t.Errorf("ResolveFor(%s): %v", test.ip, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ResolveFor(%s) = %+v, want %+v", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	conf := &Config{TrustedProxies: []string{"10.0.0.0/8", "2001:db8::/32"}}
+	if err := conf.compile(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		remote string
+		header string
+		value  string
+		want   string
+	}{
+		{"192.0.2.1:1234", "X-Forwarded-For", "198.51.100.1", "192.0.2.1"},
+		{"10.0.0.1:1234", "X-Forwarded-For", "198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"10.0.0.1:1234", "X-Forwarded-For", "203.0.113.9, 198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "X-Forwarded-For", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "Forwarded", `for=198.51.100.1;proto=https, for="[2001:db8::1]:4711"`, "198.51.100.1"},
+		{"10.0.0.1:1234", "Forwarded", "for=_hidden, for=10.0.0.2", "10.0.0.2"},
+	}
+	for _, test := range tests {
+		r := &http.Request{RemoteAddr: test.remote, Header: http.Header{}}
+		if test.value != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		if got := conf.clientIP(r); got.String() != test.want {
+			t.Errorf("clientIP(%s, %s: %s) = %s, want %s", test.remote, test.header, test.value, got, test.want)
+		}
+	}
+}
+
+func TestResolveTemplateError(t *testing.T) {
+	conf := &Config{
+		Paths: []ImportPath{
+			{Prefix: "example.com", VCS: "git", RepoTemplate: "https://github.com/{{ index . 1 }}"},
+		},
+	}
+	r, err := NewResolver(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Resolve("example.com"); err == nil || err == ErrNoMatch {
+		t.Errorf("Resolve: got error %v, want a template error", err)
+	}
+}
+
+func TestNewResolverBadTemplate(t *testing.T) {
+	conf := &Config{
+		Paths: []ImportPath{
+			{Prefix: "example.com", VCS: "git", RepoTemplate: "{{ .Foo"},
+		},
+	}
+	if _, err := NewResolver(conf); err == nil {
+		t.Error("NewResolver: got no error for a bad repo template")
+	}
+}
@@ -0,0 +1,374 @@
+package metaimport
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// defaultStatsFlushInterval is the interval between two writes of the
+// statistics to their database when the configuration doesn't say
+// otherwise.
+const defaultStatsFlushInterval = 10 * time.Second
+
+// statsBucket is the bucket of the database holding the counters.
+var statsBucket = []byte("counts")
+
+// StatsConfig holds the settings of the statistics.
+type StatsConfig struct {
+	Database      string   `doc:"File of the bbolt database in which the statistics are persisted, they are only kept in memory when empty"`
+	FlushInterval Duration `json:"flush_interval" doc:"Interval between two writes of the statistics to the database" default:"10s"`
+	Retention     Duration `doc:"Time during which the counters are kept, e.g. 8760h, forever when zero"`
+}
+
+// The clients distinguished by the statistics.
+const (
+	ClientGo      = "go"
+	ClientBrowser = "browser"
+	ClientOther   = "other"
+)
+
+// StatsKey identifies a counter of the statistics.
+type StatsKey struct {
+	// Prefix is the prefix of the matched import path
+	Prefix string
+	// Day is the day of the resolutions, in UTC, formatted as
+	// 2006-01-02
+	Day string
+	// Client is the kind of client which sent the requests:
+	// ClientGo, ClientBrowser or ClientOther
+	Client string
+}
+
+// StatsCount is the value of a counter of the statistics.
+type StatsCount struct {
+	StatsKey
+	Count uint64
+}
+
+// Stats counts the resolutions of the packages by import path, day and
+// kind of client. It's safe for concurrent use and can be shared by
+// several handlers so that the counters survive configuration reloads.
+type Stats struct {
+	mu     sync.Mutex
+	counts map[StatsKey]uint64
+	// pending holds the increments not yet written to db
+	pending map[StatsKey]uint64
+	db      *bolt.DB
+	// name is the name of the database, to open it again
+	name string
+}
+
+// NewStats returns empty statistics, kept in memory.
+func NewStats() *Stats {
+	return &Stats{counts: map[StatsKey]uint64{}}
+}
+
+// OpenStats returns the statistics persisted in the bbolt database
+// name, which is created if it doesn't exist. The increments are
+// written to the database by Flush.
+func OpenStats(name string) (*Stats, error) {
+	db, err := bolt.Open(name, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &Stats{counts: map[StatsKey]uint64{}, pending: map[StatsKey]uint64{}, db: db, name: name}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(statsBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if key, ok := parseStatsKey(k); ok && len(v) == 8 {
+				s.counts[key] = binary.BigEndian.Uint64(v)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// bytes returns the key of the counter k in the database. The keys
+// start with the day so that they are sorted by day.
+func (k StatsKey) bytes() []byte {
+	return []byte(k.Day + "\x00" + k.Prefix + "\x00" + k.Client)
+}
+
+// parseStatsKey parses the key of a counter in the database.
+func parseStatsKey(b []byte) (StatsKey, bool) {
+	fields := strings.Split(string(b), "\x00")
+	if len(fields) != 3 {
+		return StatsKey{}, false
+	}
+	return StatsKey{Day: fields[0], Prefix: fields[1], Client: fields[2]}, true
+}
+
+// Flush writes the increments of the counters to the database of s.
+// It does nothing if s is kept in memory.
+func (s *Stats) Flush() error {
+	s.mu.Lock()
+	db, pending := s.db, s.pending
+	if db != nil {
+		s.pending = map[StatsKey]uint64{}
+	}
+	s.mu.Unlock()
+	if db == nil || len(pending) == 0 {
+		return nil
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(statsBucket)
+		for k, n := range pending {
+			key := k.bytes()
+			if v := b.Get(key); len(v) == 8 {
+				n += binary.BigEndian.Uint64(v)
+			}
+			v := make([]byte, 8)
+			binary.BigEndian.PutUint64(v, n)
+			if err := b.Put(key, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Keep the increments to write them the next time
+		s.mu.Lock()
+		if s.pending != nil {
+			for k, n := range pending {
+				s.pending[k] += n
+			}
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// Prune removes the counters of the days before the one of t.
+func (s *Stats) Prune(t time.Time) error {
+	day := t.UTC().Format(time.DateOnly)
+	s.mu.Lock()
+	for k := range s.counts {
+		if k.Day < day {
+			delete(s.counts, k)
+		}
+	}
+	for k := range s.pending {
+		if k.Day < day {
+			delete(s.pending, k)
+		}
+	}
+	db := s.db
+	s.mu.Unlock()
+	if db == nil {
+		return nil
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(statsBucket).Cursor()
+		for k, _ := c.First(); k != nil && string(k) < day; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Check reports whether the database of s, if any, can be read.
+func (s *Stats) Check() error {
+	s.mu.Lock()
+	db := s.db
+	s.mu.Unlock()
+	if db == nil {
+		return nil
+	}
+	return db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(statsBucket) == nil {
+			return errors.New("missing bucket")
+		}
+		return nil
+	})
+}
+
+// Close flushes s and closes its database, s being then kept in memory
+// until Reopen is called.
+func (s *Stats) Close() error {
+	err := s.Flush()
+	s.mu.Lock()
+	db := s.db
+	s.db, s.pending = nil, nil
+	s.mu.Unlock()
+	if db == nil {
+		return err
+	}
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Reopen opens again the database of s closed by Close, the increments
+// counted in the meantime being lost for the database. It does nothing
+// if s has always been kept in memory.
+func (s *Stats) Reopen() error {
+	if s.name == "" {
+		return nil
+	}
+	db, err := bolt.Open(s.name, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.db, s.pending = db, map[StatsKey]uint64{}
+	s.mu.Unlock()
+	return nil
+}
+
+// Persist flushes s every interval and, if retention is not zero,
+// prunes the counters older than retention. It never returns.
+func (s *Stats) Persist(interval, retention time.Duration) {
+	if interval <= 0 {
+		interval = defaultStatsFlushInterval
+	}
+	for range time.Tick(interval) {
+		if err := s.Flush(); err != nil {
+			slog.Error("failed to write the statistics", "err", err)
+		}
+		if retention > 0 {
+			if err := s.Prune(time.Now().Add(-retention)); err != nil {
+				slog.Error("failed to prune the statistics", "err", err)
+			}
+		}
+	}
+}
+
+// Add increments the counter of the resolutions of the import path
+// prefix by client at t.
+func (s *Stats) Add(prefix, client string, t time.Time) {
+	k := StatsKey{Prefix: prefix, Day: t.UTC().Format(time.DateOnly), Client: client}
+	s.mu.Lock()
+	s.counts[k]++
+	if s.pending != nil {
+		s.pending[k]++
+	}
+	s.mu.Unlock()
+}
+
+// Counts returns the counters, sorted by day, prefix and client.
+func (s *Stats) Counts() []StatsCount {
+	s.mu.Lock()
+	counts := make([]StatsCount, 0, len(s.counts))
+	for k, n := range s.counts {
+		counts = append(counts, StatsCount{StatsKey: k, Count: n})
+	}
+	s.mu.Unlock()
+	sort.Slice(counts, func(i, j int) bool {
+		a, b := counts[i], counts[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Prefix != b.Prefix {
+			return a.Prefix < b.Prefix
+		}
+		return a.Client < b.Client
+	})
+	return counts
+}
+
+// client returns the kind of client which sent r, the go command
+// sending go-get queries with the default user agent of net/http.
+func client(r *http.Request) string {
+	switch {
+	case r.URL.Query().Get("go-get") == "1" && strings.HasPrefix(r.UserAgent(), "Go-http-client/"):
+		return ClientGo
+	case isBrowser(r):
+		return ClientBrowser
+	}
+	return ClientOther
+}
+
+// statsInfo is the JSON object describing a counter of the
+// statistics.
+type statsInfo struct {
+	Prefix string `json:"prefix"`
+	Day    string `json:"day"`
+	Client string `json:"client"`
+	Count  uint64 `json:"count"`
+}
+
+// serveStats writes the statistics as JSON or, if the format parameter
+// of r is csv, as CSV. The counters can be filtered with the prefix
+// parameter, matching the import paths starting with it, and the from
+// and to parameters, the first and last days formatted as 2006-01-02.
+// Only the counters of the packages disclosed to the client are written.
+func (h *Handler) serveStats(w http.ResponseWriter, r *http.Request) {
+	if h.Stats == nil {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	for _, name := range []string{"from", "to"} {
+		if v := q.Get(name); v != "" {
+			if _, err := time.Parse(time.DateOnly, v); err != nil {
+				http.Error(w, "bad "+name+" parameter: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	prefix, from, to := q.Get("prefix"), q.Get("from"), q.Get("to")
+	disclosed := map[string]bool{}
+	for i, p := range h.conf.Paths {
+		if h.disclosed(i, r) {
+			disclosed[p.Prefix] = true
+		}
+	}
+	counts := []statsInfo{}
+	for _, c := range h.Stats.Counts() {
+		if !strings.HasPrefix(c.Prefix, prefix) || from != "" && c.Day < from || to != "" && c.Day > to {
+			continue
+		}
+		// The counters of the packages not disclosed to the client are
+		// left out, as in the list of the import paths
+		if !disclosed[c.Prefix] {
+			continue
+		}
+		counts = append(counts, statsInfo{Prefix: c.Prefix, Day: c.Day, Client: c.Client, Count: c.Count})
+	}
+	switch q.Get("format") {
+	case "", "json":
+		data, err := json.MarshalIndent(map[string]interface{}{"counts": counts}, "", "  ")
+		if err != nil {
+			slog.ErrorContext(r.Context(), "failed to encode the statistics", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="stats.csv"`)
+		w.WriteHeader(http.StatusOK)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"prefix", "day", "client", "count"})
+		for _, c := range counts {
+			cw.Write([]string{c.Prefix, c.Day, c.Client, strconv.FormatUint(c.Count, 10)})
+		}
+		cw.Flush()
+	default:
+		http.Error(w, "bad format parameter, expected json or csv", http.StatusBadRequest)
+	}
+}
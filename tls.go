@@ -0,0 +1,67 @@
+package metaimport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+)
+
+// tlsVersions maps the names of the TLS versions to their values.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCurves maps the names of the elliptic curves to their values.
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+// cipherSuite returns the value of the cipher suite name, as named by
+// the crypto/tls package, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256.
+func cipherSuite(name string) (uint16, bool) {
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, s := range suites {
+			if s.Name == name {
+				return s.ID, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Apply sets the minimum version, the cipher suites and the curves of t on c.
+func (t *TLSConfig) Apply(c *tls.Config) error {
+	if t.MinVersion != "" {
+		version, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return fmt.Errorf("conf: unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", t.MinVersion)
+		}
+		c.MinVersion = version
+	}
+	c.CipherSuites = nil
+	for _, name := range t.CipherSuites {
+		id, ok := cipherSuite(name)
+		if !ok {
+			return fmt.Errorf("conf: unknown cipher suite %q", name)
+		}
+		c.CipherSuites = append(c.CipherSuites, id)
+	}
+	if len(c.CipherSuites) > 0 && !slices.Contains(c.CipherSuites, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) && !slices.Contains(c.CipherSuites, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256) {
+		return fmt.Errorf("conf: cipher_suites must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, required by HTTP/2")
+	}
+	c.CurvePreferences = nil
+	for _, name := range t.Curves {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return fmt.Errorf("conf: unknown curve %q, expected X25519, P-256, P-384 or P-521", name)
+		}
+		c.CurvePreferences = append(c.CurvePreferences, id)
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package metaimport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultServiceName = "metaimport"
+	// maxPendingSpans is the maximum number of spans waiting to be
+	// exported, the new ones are dropped when it's reached
+	maxPendingSpans = 2048
+	// spanBatchSize is the number of spans from which they are
+	// exported without waiting for the export interval
+	spanBatchSize  = 512
+	exportInterval = 5 * time.Second
+)
+
+// otlpClient is the client used to send the spans to the collector.
+var otlpClient = &http.Client{Timeout: 10 * time.Second}
+
+// TracingConfig holds the settings of the export of the traces.
+type TracingConfig struct {
+	Endpoint    string            `doc:"Base URL of the OTLP/HTTP collector the spans are sent to, e.g. http://localhost:4318" schema:"required"`
+	ServiceName string            `json:"service_name" doc:"Name of the service reported in the spans" default:"metaimport"`
+	Headers     map[string]string `doc:"Headers added to the requests sent to the collector"`
+}
+
+// Tracer records a span per request and exports them in batches to an
+// OTLP/HTTP collector, encoded as JSON. It can be shared by several
+// handlers so that it survives configuration reloads.
+type Tracer struct {
+	conf  TracingConfig
+	spans chan *span
+}
+
+// NewTracer returns a tracer exporting the spans as configured by
+// conf.
+func NewTracer(conf *TracingConfig) *Tracer {
+	t := &Tracer{conf: *conf, spans: make(chan *span, maxPendingSpans)}
+	if t.conf.ServiceName == "" {
+		t.conf.ServiceName = defaultServiceName
+	}
+	go t.export()
+	return t
+}
+
+// span is the span of a request.
+type span struct {
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	status   int
+}
+
+// randomID returns a random identifier of n bytes, hex encoded.
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parseTraceparent returns the trace ID and the parent span ID given
+// by the W3C traceparent header value v, if it's valid.
+func parseTraceparent(v string) (traceID, parentID string, ok bool) {
+	fields := strings.Split(v, "-")
+	if len(fields) != 4 || len(fields[1]) != 32 || len(fields[2]) != 16 {
+		return "", "", false
+	}
+	for _, f := range fields[1:3] {
+		if _, err := hex.DecodeString(f); err != nil || strings.Trim(f, "0") == "" {
+			return "", "", false
+		}
+	}
+	return strings.ToLower(fields[1]), strings.ToLower(fields[2]), true
+}
+
+// start starts the span of the request r.
+func (t *Tracer) start(r *http.Request) *span {
+	s := &span{
+		spanID: randomID(8),
+		name:   r.Method,
+		start:  time.Now(),
+		attrs: map[string]string{
+			"http.request.method": r.Method,
+			"url.path":            r.URL.Path,
+			"server.address":      r.Host,
+			"user_agent.original": r.UserAgent(),
+		},
+	}
+	if traceID, parentID, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		s.traceID, s.parentID = traceID, parentID
+	} else {
+		s.traceID = randomID(16)
+	}
+	return s
+}
+
+// end ends the span s of a request answered with the status code
+// status, about which info has been gathered, and queues it for
+// export. It's dropped if too many spans are waiting.
+func (t *Tracer) end(s *span, info *requestInfo, status int) {
+	s.end = time.Now()
+	s.status = status
+	for k, v := range map[string]string{
+		"metaimport.package":    info.pkg,
+		"metaimport.prefix":     info.prefix,
+		"metaimport.vcs":        info.vcs,
+		"metaimport.request_id": info.id,
+	} {
+		if v != "" {
+			s.attrs[k] = v
+		}
+	}
+	select {
+	case t.spans <- s:
+	default:
+	}
+}
+
+// export exports the recorded spans, every export interval or as soon
+// as a batch is complete.
+func (t *Tracer) export() {
+	ticker := time.NewTicker(exportInterval)
+	var batch []*span
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.send(batch); err != nil {
+			slog.Warn("failed to export spans", "count", len(batch), "err", err)
+		}
+		batch = nil
+	}
+}
+
+// otlpAttributes returns attrs as OTLP attributes.
+func otlpAttributes(attrs map[string]string) []interface{} {
+	var l []interface{}
+	for k, v := range attrs {
+		l = append(l, map[string]interface{}{"key": k, "value": map[string]string{"stringValue": v}})
+	}
+	return l
+}
+
+// send sends spans to the collector.
+func (t *Tracer) send(spans []*span) error {
+	var l []interface{}
+	for _, s := range spans {
+		attrs := otlpAttributes(s.attrs)
+		attrs = append(attrs, map[string]interface{}{
+			"key":   "http.response.status_code",
+			"value": map[string]string{"intValue": strconv.Itoa(s.status)},
+		})
+		o := map[string]interface{}{
+			"traceId":           s.traceID,
+			"spanId":            s.spanID,
+			"name":              s.name,
+			"kind":              2, // SPAN_KIND_SERVER
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attrs,
+		}
+		if s.parentID != "" {
+			o["parentSpanId"] = s.parentID
+		}
+		if s.status >= 500 {
+			o["status"] = map[string]int{"code": 2} // STATUS_CODE_ERROR
+		}
+		l = append(l, o)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]string{"service.name": t.conf.ServiceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "github.com/montag451/metaimport"},
+						"spans": l,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(t.conf.Endpoint, "/")+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.conf.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := otlpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
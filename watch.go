@@ -0,0 +1,138 @@
+package metaimport
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDelay is the time to wait after a change to the configuration
+// file before reloading it, so that a burst of events triggers a
+// single reload.
+const reloadDelay = 100 * time.Millisecond
+
+// reload reloads the configuration name and passes it to fn if it
+// has been successfully loaded. The new configuration is returned, nil
+// if it failed to load.
+func reload(name string, fn func(*Config)) *Config {
+	slog.Info("reloading configuration", "name", name)
+	conf, err := LoadConfig(name)
+	if err != nil {
+		slog.Error("failed to reload configuration", "name", name, "err", err)
+		return nil
+	}
+	fn(conf)
+	return conf
+}
+
+// Watch watches the configuration name, whose current version is conf,
+// as requested by its settings and calls fn with the new version each
+// time it is modified. When watch is set, the directory holding the
+// file is watched rather than the file itself so that files replaced
+// by a rename, as done by editors and by Kubernetes when updating a
+// mounted ConfigMap, are detected. If name is a configuration
+// directory, it is watched directly and any change to one of its
+// configuration files triggers a reload. Remote configurations are
+// polled instead and configurations stored in a KV store are watched
+// using the API of the store. The import paths defined in a Kubernetes
+// cluster, if used, and the template files are watched as well. As a
+// configuration failing to load is not passed to fn, the last good
+// version of the templates keeps being used when they have errors.
+func Watch(name string, conf *Config, fn func(*Config)) error {
+	if conf.Kubernetes != nil {
+		go watchImportPaths(name, conf, fn)
+	}
+	var files []string
+	for _, file := range []string{conf.Template, conf.LandingTemplate, conf.IndexTemplate, conf.NotFoundTemplate} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	if conf.Watch {
+		switch {
+		case isKVURL(name):
+			go watchKV(name, conf, fn)
+		case isURL(name):
+			interval := time.Duration(conf.WatchInterval)
+			if interval <= 0 {
+				interval = defaultPollInterval
+			}
+			go pollConfig(name, interval, conf, fn)
+		default:
+			files = append(files, name)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	return WatchFiles(files, func() {
+		reload(name, fn)
+	})
+}
+
+// WatchFiles calls fn each time one of the given files is modified. A
+// burst of modifications triggers a single call. If a file is a
+// directory, fn is called when one of the configuration files it holds
+// is modified.
+func WatchFiles(names []string, fn func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// files maps the watched directories to the base names of the
+	// files watched in them, an empty name standing for all the
+	// configuration files
+	files := map[string]map[string]bool{}
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			watcher.Close()
+			return err
+		}
+		dir, file := filepath.Split(filepath.Clean(name))
+		if fi.IsDir() {
+			dir, file = name, ""
+		}
+		dir = filepath.Clean(dir)
+		if files[dir] == nil {
+			if err := watcher.Add(dir); err != nil {
+				watcher.Close()
+				return err
+			}
+			files[dir] = map[string]bool{}
+		}
+		files[dir][file] = true
+	}
+	go func() {
+		defer watcher.Close()
+		timer := time.NewTimer(reloadDelay)
+		timer.Stop()
+		for {
+			select {
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				dir, base := filepath.Split(ev.Name)
+				watched := files[filepath.Clean(dir)]
+				// Kubernetes swaps the "..data" symlink when a
+				// ConfigMap is updated
+				if watched[base] || (watched[""] && isConfigFile(base)) || strings.HasPrefix(base, "..") {
+					timer.Reset(reloadDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("failed to watch files", "err", err)
+			case <-timer.C:
+				fn()
+			}
+		}
+	}()
+	return nil
+}